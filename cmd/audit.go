@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/Fishwaldo/restic-nats-server/internal/audit"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	auditKey     string
+	auditRotated bool
+
+	auditCmd = &cobra.Command{
+		Use:   "audit",
+		Short: "Audit Log Tools",
+	}
+
+	auditVerifyCmd = &cobra.Command{
+		Use:   "verify [file...]",
+		Short: "Verify the hash chain and signed checkpoints in Audit Logs",
+		Long: `Verify checks that no Audit Records have been changed, removed or reordered.
+Rotated files should be listed oldest first, followed by the current file.
+Without any files, the audit.file from the config file is checked.
+Checkpoints are checked against --key, or audit.publickey from the config file.
+Records after the last Checkpoint are not signed yet, and are reported as a
+Warning. They are signed by the next Checkpoint, or when the server shuts down.
+A log without any valid Checkpoint is reported as a Break.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				if file := viper.GetString("audit.file"); file != "" {
+					args = append(args, file)
+				} else {
+					return errors.New("No Audit Log Files given")
+				}
+			}
+			if auditKey == "" {
+				auditKey = viper.GetString("audit.publickey")
+			}
+			if auditKey == "" {
+				return errors.New("No Public Key given. Use --key or set audit.publickey")
+			}
+			report, err := audit.Verify(args, auditKey, auditRotated)
+			if err != nil {
+				return err
+			}
+			for _, note := range report.Notes {
+				fmt.Println("Note:", note)
+			}
+			for _, warning := range report.Warnings {
+				fmt.Println("Warning:", warning)
+			}
+			for _, brk := range report.Breaks {
+				fmt.Println("BROKEN:", brk)
+			}
+			fmt.Printf("%d Records, %d Valid Checkpoints, %d Unsigned, %d Breaks\n", report.Records, report.Checkpoints, report.Unsigned, len(report.Breaks))
+			if len(report.Breaks) > 0 {
+				cmd.SilenceUsage = true
+				return errors.New("Audit Log Verification Failed")
+			}
+			return nil
+		},
+	}
+)
+
+func init() {
+	auditVerifyCmd.Flags().StringVar(&auditKey, "key", "", "Public Key that signs the Checkpoints")
+	auditVerifyCmd.Flags().BoolVar(&auditRotated, "rotated", false, "The first file starts part way through the chain, as older files were rotated away")
+	auditCmd.AddCommand(auditVerifyCmd)
+	rootCmd.AddCommand(auditCmd)
+}
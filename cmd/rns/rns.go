@@ -2,12 +2,20 @@ package rns
 
 import (
 	"github.com/Fishwaldo/restic-nats-server/internal"
+	"github.com/Fishwaldo/restic-nats-server/internal/audit"
 	"github.com/Fishwaldo/restic-nats-server/internal/cache"
+	"github.com/Fishwaldo/restic-nats-server/internal/httpserver"
 	"github.com/Fishwaldo/restic-nats-server/internal/natsserver"
+	"github.com/Fishwaldo/restic-nats-server/internal/tracing"
+	"github.com/Fishwaldo/restic-nats-server/internal/webhook"
 )
 
 func StartServies() {
 	internal.StartLogger()
+	tracing.Start()
+	audit.Start()
+	webhook.Start()
 	natsserver.Start()
 	cache.Start()
+	httpserver.Start()
 }
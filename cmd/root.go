@@ -16,7 +16,11 @@ var (
 	rootCmd = &cobra.Command{
 		Use:   "rns",
 		Short: "Restic Nats Server",
-		Long: `Restic Nats Server implements a worker based backend for Restic`,
+		Long: `Restic Nats Server implements a worker based backend for Restic
+
+The config is read from rns.json in the current directory or conf/. The sample
+conf/rns.json runs as is. conf/rns.example.json shows the other settings, such
+as TLS, NKeys, the signed Audit Log, Hook Scripts and Webhooks`,
 		Run: func(cmd *cobra.Command, args []string) {
 			LoadConfig()
 			fmt.Println("Starting Services....")
@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/Fishwaldo/restic-nats-server/cmd/rns"
+	"github.com/Fishwaldo/restic-nats-server/internal/worker"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var workerCmd = &cobra.Command{
+	Use:   "worker",
+	Short: "Start only the Workers",
+	Long: `Start only the Workers, connecting to the Nats Server in worker.connecturl.
+The Embedded Nats and Cache Servers are not started.
+
+Sessions are held by the process that opened them, and the ClientID names that
+process. Requests for a Session that reach another process are forwarded to it,
+so any number of processes can serve the same Account. If the process that
+opened a Session stops, its Sessions are lost and the client has to Open again.
+
+The Role of a Host User is looked up from the user in the Nats-Request-Info
+header. The Nats Server only adds it if each Host Account shares its client
+info with the Worker Account on the service import, for example:
+
+  imports: [{service: {account: Worker, subject: "repo.Hosts.>"}, to: "repo.>", share: true}]
+
+Without it every request is refused, and a warning is logged on the first one.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		viper.Set("start-nats-server", false)
+		viper.Set("start-cache-server", false)
+		LoadConfig()
+		fmt.Println("Starting Services....")
+		rns.StartServies()
+		fmt.Println("Starting Workers....")
+		worker.StartWorker()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(workerCmd)
+}
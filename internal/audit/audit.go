@@ -0,0 +1,208 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Fishwaldo/go-logadapter"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/Fishwaldo/restic-nats-server/internal"
+)
+
+var log logadapter.Logger
+
+// Record is a single entry in the Audit Log
+type Record struct {
+	//Seq - the position of the record in the chain
+	Seq uint64 `json:"seq"`
+	//Prev - SHA256 of the previous record, exactly as it was written
+	Prev string    `json:"prev"`
+	Time time.Time `json:"time"`
+	//MsgID - the Message ID the client assigned to the request
+	MsgID   string `json:"msgid,omitempty"`
+	User    string `json:"user,omitempty"`
+	Account string `json:"account,omitempty"`
+	//Session - the Session ID (ClientID) the request was sent on
+	Session string `json:"session,omitempty"`
+	Repo    string `json:"repo,omitempty"`
+	Op      string `json:"op"`
+	Path    string `json:"path,omitempty"`
+	Bytes   int64  `json:"bytes"`
+	//Result - ok, failed, refused or expired
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+	//Replayed - the request was a duplicate, and was not run again
+	Replayed bool `json:"replayed,omitempty"`
+	//Key - the public key that signed a checkpoint
+	Key string `json:"key,omitempty"`
+	//Signature - the signature of a checkpoint
+	Signature string `json:"sig,omitempty"`
+}
+
+type auditConfigT struct {
+	File       string
+	MaxSize    int
+	MaxBackups int
+	MaxAge     int
+	Compress   bool
+	Subject    string
+	KeyFile    string
+	//PublicKey - the public key of KeyFile, that audit verify checks the Checkpoints against
+	PublicKey string
+	//CheckpointInterval - write a signed checkpoint after this many records
+	CheckpointInterval int
+}
+
+var auditConfig auditConfigT
+
+var (
+	mx     sync.Mutex
+	output io.WriteCloser
+	nc     *nats.Conn
+)
+
+func init() {
+	log = internal.Log.New("audit")
+	viper.SetDefault("audit.maxsize", 100)
+	viper.SetDefault("audit.maxbackups", 10)
+	viper.SetDefault("audit.checkpointinterval", 1000)
+	internal.ConfigRegister("audit", parseConfig, validateConfig)
+}
+
+func parseConfig(cfg *viper.Viper) error {
+	auditConfig.File = cfg.GetString("file")
+	auditConfig.MaxSize = cfg.GetInt("maxsize")
+	auditConfig.MaxBackups = cfg.GetInt("maxbackups")
+	auditConfig.MaxAge = cfg.GetInt("maxage")
+	auditConfig.Compress = cfg.GetBool("compress")
+	auditConfig.Subject = cfg.GetString("subject")
+	auditConfig.KeyFile = cfg.GetString("keyfile")
+	auditConfig.PublicKey = cfg.GetString("publickey")
+	auditConfig.CheckpointInterval = cfg.GetInt("checkpointinterval")
+	/* viper.Sub drops the defaults if the section exists */
+	if !cfg.IsSet("maxsize") {
+		auditConfig.MaxSize = 100
+	}
+	if !cfg.IsSet("maxbackups") {
+		auditConfig.MaxBackups = 10
+	}
+	if !cfg.IsSet("checkpointinterval") {
+		auditConfig.CheckpointInterval = 1000
+	}
+	return nil
+}
+
+func validateConfig() (warnings []error, err error) {
+	if auditConfig.MaxSize <= 0 {
+		return nil, errors.New("audit.maxsize must be greater than 0")
+	}
+	if auditConfig.MaxBackups < 0 || auditConfig.MaxAge < 0 {
+		return nil, errors.New("audit.maxbackups and audit.maxage can not be negative")
+	}
+	if auditConfig.CheckpointInterval < 0 {
+		return nil, errors.New("audit.checkpointinterval can not be negative")
+	}
+	if auditConfig.PublicKey != "" && !nkeys.IsValidPublicServerKey(auditConfig.PublicKey) {
+		return nil, errors.Errorf("audit.publickey %s is not a valid Server Public Key", auditConfig.PublicKey)
+	}
+	if auditConfig.File == "" && auditConfig.Subject == "" {
+		warnings = append(warnings, errors.New("No Audit Log Configured"))
+	}
+	if auditConfig.File != "" && auditConfig.KeyFile == "" {
+		warnings = append(warnings, errors.New("No audit.keyfile Configured. Audit Checkpoints will not be signed"))
+	}
+	return warnings, nil
+}
+
+// Start opens the Audit Log file and continues the hash chain from the last record in it
+func Start() {
+	if auditConfig.File == "" {
+		return
+	}
+	mx.Lock()
+	defer mx.Unlock()
+	if auditConfig.KeyFile != "" {
+		if err := loadKey(auditConfig.KeyFile); err != nil {
+			log.Fatal("Can't Load Audit Key: %s", err)
+		}
+	}
+	if err := resumeChain(auditConfig.File); err != nil {
+		log.Fatal("Can't Read Audit Log %s: %s", auditConfig.File, err)
+	}
+	output = &lumberjack.Logger{
+		Filename:   auditConfig.File,
+		MaxSize:    auditConfig.MaxSize,
+		MaxBackups: auditConfig.MaxBackups,
+		MaxAge:     auditConfig.MaxAge,
+		Compress:   auditConfig.Compress,
+	}
+	log.Info("Writing Audit Log to %s", auditConfig.File)
+}
+
+// SetConn sets the NATS connection used to publish records, if audit.subject is configured
+func SetConn(conn *nats.Conn) {
+	if auditConfig.Subject == "" {
+		return
+	}
+	mx.Lock()
+	defer mx.Unlock()
+	nc = conn
+	log.Info("Publishing Audit Records to %s", auditConfig.Subject)
+}
+
+// Write appends a record to the Audit Log
+func Write(rec *Record) {
+	mx.Lock()
+	defer mx.Unlock()
+	write(rec)
+	if signer != nil && auditConfig.CheckpointInterval > 0 && sinceCheckpoint >= auditConfig.CheckpointInterval {
+		writeCheckpoint()
+	}
+}
+
+//write adds the record to the chain and writes it out. Must be called with mx held
+func write(rec *Record) {
+	rec.Seq = chain.seq
+	rec.Prev = chain.prev
+	data, err := json.Marshal(rec)
+	if err != nil {
+		log.Warn("Can't Encode Audit Record: %s", err)
+		return
+	}
+	chain.next(data)
+	sinceCheckpoint++
+	if output != nil {
+		if _, err := output.Write(append(data, '\n')); err != nil {
+			log.Error("Audit Log Write Failed: %s", err)
+		}
+	}
+	if nc != nil {
+		if err := nc.Publish(auditConfig.Subject, data); err != nil {
+			log.Warn("Audit Record Publish Failed: %s", err)
+		}
+	}
+}
+
+// Shutdown closes the Audit Log
+func Shutdown() {
+	mx.Lock()
+	defer mx.Unlock()
+	if signer != nil && sinceCheckpoint > 0 {
+		writeCheckpoint()
+	}
+	if output != nil {
+		log.Info("Closing Audit Log")
+		if err := output.Close(); err != nil {
+			log.Warn("Audit Log Close Failed: %s", err)
+		}
+		output = nil
+	}
+	nc = nil
+}
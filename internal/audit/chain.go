@@ -0,0 +1,151 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/nats-io/nkeys"
+	"github.com/pkg/errors"
+)
+
+/* Each record holds the SHA256 of the line before it, so changing, removing
+ * or reordering a record breaks the chain from that point on. Every
+ * checkpointinterval records we write a checkpoint record, signed with the
+ * server key, so the chain can't simply be rebuilt after it was modified */
+
+//CheckpointOp is the Op of a signed checkpoint record
+const CheckpointOp = "checkpoint"
+
+type chainT struct {
+	//seq - the Seq of the next record
+	seq uint64
+	//prev - the hash of the last record written
+	prev string
+}
+
+func (c *chainT) next(line []byte) {
+	c.seq++
+	c.prev = hashLine(line)
+}
+
+var (
+	chain           chainT
+	signer          nkeys.KeyPair
+	signerPublic    string
+	sinceCheckpoint int
+)
+
+func hashLine(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+//checkpointPayload is what a checkpoint signs. As prev is the hash of the
+//record before it, this covers the entire chain up to the checkpoint
+func checkpointPayload(seq uint64, prev string) []byte {
+	return []byte(fmt.Sprintf("rns-audit-checkpoint:%d:%s", seq, prev))
+}
+
+//loadKey loads the server key used to sign checkpoints, creating one if the file doesn't exist
+func loadKey(keyfile string) error {
+	seed, err := os.ReadFile(keyfile)
+	if errors.Is(err, os.ErrNotExist) {
+		kp, err := nkeys.CreateServer()
+		if err != nil {
+			return errors.Wrap(err, "Create Key")
+		}
+		if seed, err = kp.Seed(); err != nil {
+			return errors.Wrap(err, "Create Key")
+		}
+		if err := os.WriteFile(keyfile, append(seed, '\n'), 0600); err != nil {
+			return errors.Wrap(err, "Save Key")
+		}
+		log.Warn("Created New Audit Key %s", keyfile)
+	} else if err != nil {
+		return err
+	}
+	signer, err = nkeys.FromSeed(bytes.TrimSpace(seed))
+	if err != nil {
+		return errors.Wrap(err, "Invalid Key")
+	}
+	if signerPublic, err = signer.PublicKey(); err != nil {
+		return errors.Wrap(err, "Invalid Key")
+	}
+	log.Info("Signing Audit Checkpoints with %s", signerPublic)
+	if auditConfig.PublicKey != "" && auditConfig.PublicKey != signerPublic {
+		log.Warn("audit.publickey %s does not match %s. audit verify will fail", auditConfig.PublicKey, signerPublic)
+	}
+	return nil
+}
+
+//writeCheckpoint writes a signed checkpoint record. Must be called with mx held
+func writeCheckpoint() {
+	sig, err := signer.Sign(checkpointPayload(chain.seq, chain.prev))
+	if err != nil {
+		log.Error("Can't Sign Audit Checkpoint: %s", err)
+		return
+	}
+	write(&Record{
+		Time:      time.Now(),
+		Op:        CheckpointOp,
+		Key:       signerPublic,
+		Signature: base64.StdEncoding.EncodeToString(sig),
+	})
+	sinceCheckpoint = 0
+}
+
+//resumeChain continues the chain from the last record in the Audit Log
+func resumeChain(filename string) error {
+	last, err := lastLine(filename)
+	if err != nil {
+		return err
+	}
+	if last == nil {
+		log.Info("Starting New Audit Chain")
+		chain = chainT{}
+		return nil
+	}
+	var rec Record
+	if err := json.Unmarshal(last, &rec); err != nil {
+		/* still chain to it, verify will report the bad record */
+		log.Warn("Last Audit Record is corrupt: %s", err)
+	}
+	chain = chainT{seq: rec.Seq, prev: rec.Prev}
+	chain.next(last)
+	log.Info("Continuing Audit Chain from Record %d", rec.Seq)
+	return nil
+}
+
+//lastLine returns the last non empty line of a file, or nil if there is none
+func lastLine(filename string) ([]byte, error) {
+	f, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var last []byte
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxLine)
+	for scanner.Scan() {
+		if line := scanner.Bytes(); len(bytes.TrimSpace(line)) > 0 {
+			last = append(last[:0], line...)
+		}
+	}
+	if err := scanner.Err(); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return last, nil
+}
+
+//maxLine is the longest record we will read back
+const maxLine = 1024 * 1024
@@ -0,0 +1,156 @@
+package audit
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/nats-io/nkeys"
+	"github.com/pkg/errors"
+)
+
+// VerifyReport is the result of checking Audit Log files
+type VerifyReport struct {
+	Records     int
+	Checkpoints int
+	//Unsigned - Records after the last valid checkpoint. A live log always has some, so
+	//they are reported as a Warning. They could have been changed or removed without it being detected
+	Unsigned int
+	//Breaks - where the chain is broken, a checkpoint is invalid, or no records are signed
+	Breaks []string
+	//Warnings - records that are not signed yet
+	Warnings []string
+	//Notes - things that are not errors, but should be checked
+	Notes []string
+}
+
+type verifier struct {
+	report VerifyReport
+	key    nkeys.KeyPair
+	//rotated - the first file may start part way through the chain
+	rotated  bool
+	havePrev bool
+	seq      uint64
+	prev     string
+	//where - the last record checked
+	where string
+}
+
+// Verify checks the hash chain and checkpoint signatures in Audit Log files.
+// Rotated files must be given oldest first, followed by the current file.
+// Checkpoints must be signed by publicKey. The chain must start at the first
+// record, unless rotated is set because older files were rotated away
+func Verify(files []string, publicKey string, rotated bool) (*VerifyReport, error) {
+	if publicKey == "" {
+		return nil, errors.New("A Public Key is needed to verify the Checkpoints")
+	}
+	v := &verifier{rotated: rotated}
+	var err error
+	if v.key, err = nkeys.FromPublicKey(publicKey); err != nil {
+		return nil, errors.Wrap(err, "Invalid Public Key")
+	}
+	for _, file := range files {
+		if err := v.verifyFile(file); err != nil {
+			return nil, errors.Wrap(err, file)
+		}
+	}
+	switch {
+	case v.report.Unsigned > 0 && v.report.Checkpoints == 0:
+		v.breakAt(v.where, fmt.Sprintf("None of the %d Records are signed", v.report.Unsigned))
+	case v.report.Unsigned > 0:
+		v.report.Warnings = append(v.report.Warnings, fmt.Sprintf("%s: %d Records after the last Checkpoint are not signed yet", v.where, v.report.Unsigned))
+	}
+	return &v.report, nil
+}
+
+func (v *verifier) verifyFile(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var rd io.Reader = f
+	if strings.HasSuffix(file, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		rd = gz
+	}
+
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(make([]byte, 64*1024), maxLine)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := scanner.Bytes()
+		if strings.TrimSpace(string(line)) == "" {
+			continue
+		}
+		v.verifyLine(fmt.Sprintf("%s:%d", file, lineno), line)
+	}
+	return scanner.Err()
+}
+
+func (v *verifier) verifyLine(where string, line []byte) {
+	v.where = where
+	v.report.Records++
+	v.report.Unsigned++
+	var rec Record
+	if err := json.Unmarshal(line, &rec); err != nil {
+		v.breakAt(where, fmt.Sprintf("Not a valid Audit Record: %s", err))
+		v.havePrev = false
+		return
+	}
+	switch {
+	case v.havePrev && (rec.Seq != v.seq || rec.Prev != v.prev):
+		if rec.Seq == 0 && rec.Prev == "" {
+			v.breakAt(where, "Chain restarted")
+		} else {
+			v.breakAt(where, fmt.Sprintf("Record %d does not follow Record %d", rec.Seq, v.seq-1))
+		}
+	case !v.havePrev && (rec.Seq != 0 || rec.Prev != ""):
+		/* records removed from the start of the chain can only be told apart
+		 * from files that were rotated away if we are told so */
+		if v.report.Records == 1 && !v.rotated {
+			v.breakAt(where, fmt.Sprintf("Chain starts at Record %d, not 0. Older files may be missing", rec.Seq))
+		} else {
+			v.report.Notes = append(v.report.Notes, fmt.Sprintf("%s: Checking Chain from Record %d", where, rec.Seq))
+		}
+	}
+	if rec.Op == CheckpointOp {
+		v.verifyCheckpoint(where, &rec)
+	}
+	v.havePrev = true
+	v.seq = rec.Seq + 1
+	v.prev = hashLine(line)
+}
+
+//verifyCheckpoint checks the signature of a checkpoint with the Public Key we were given.
+//The Key in the checkpoint is only informational, as whoever wrote it could have chosen it
+func (v *verifier) verifyCheckpoint(where string, rec *Record) {
+	if pub, _ := v.key.PublicKey(); rec.Key != "" && rec.Key != pub {
+		v.breakAt(where, fmt.Sprintf("Checkpoint signed by unknown Key %s", rec.Key))
+		return
+	}
+	sig, err := base64.StdEncoding.DecodeString(rec.Signature)
+	if err == nil {
+		err = v.key.Verify(checkpointPayload(rec.Seq, rec.Prev), sig)
+	}
+	if err != nil {
+		v.breakAt(where, fmt.Sprintf("Checkpoint at Record %d has a invalid Signature", rec.Seq))
+		return
+	}
+	v.report.Checkpoints++
+	v.report.Unsigned = 0
+}
+
+func (v *verifier) breakAt(where string, reason string) {
+	v.report.Breaks = append(v.report.Breaks, fmt.Sprintf("%s: %s", where, reason))
+}
@@ -0,0 +1,180 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nkeys"
+)
+
+//writeLog writes a Audit Log of records, with a checkpoint every interval
+//records, and returns its lines. If signTail is set, it ends with a checkpoint
+func writeLog(t *testing.T, kp nkeys.KeyPair, records, interval int, signTail bool) [][]byte {
+	t.Helper()
+	var buf bytes.Buffer
+	mx.Lock()
+	defer mx.Unlock()
+	chain = chainT{}
+	sinceCheckpoint = 0
+	signer = kp
+	signerPublic, _ = kp.PublicKey()
+	auditConfig.CheckpointInterval = interval
+	output = nopCloser{&buf}
+	defer func() {
+		output, signer = nil, nil
+	}()
+	for i := 0; i < records; i++ {
+		write(&Record{Op: "save", Repo: "repo1", Path: "data/00"})
+		if interval > 0 && sinceCheckpoint >= interval {
+			writeCheckpoint()
+		}
+	}
+	if signTail && sinceCheckpoint > 0 {
+		writeCheckpoint()
+	}
+	return bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+}
+
+type nopCloser struct {
+	*bytes.Buffer
+}
+
+func (nopCloser) Close() error { return nil }
+
+func saveLog(t *testing.T, lines [][]byte) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "audit.log")
+	if err := os.WriteFile(file, append(bytes.Join(lines, []byte("\n")), '\n'), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestVerify(t *testing.T) {
+	kp, _ := nkeys.CreateServer()
+	pub, _ := kp.PublicKey()
+	other, _ := nkeys.CreateServer()
+	otherpub, _ := other.PublicKey()
+
+	/* 10 records with a checkpoint after every 4, and one at the end: 13 lines */
+	signed := func() [][]byte { return writeLog(t, kp, 10, 4, true) }
+
+	tests := []struct {
+		name       string
+		lines      func() [][]byte
+		key        string
+		rotated    bool
+		wantBreaks bool
+		wantErr    bool
+	}{
+		{"valid", signed, pub, false, false, false},
+		{"no key", signed, "", false, false, true},
+		{"invalid key", signed, "not-a-key", false, false, true},
+		{"wrong key", signed, otherpub, false, true, false},
+		/* a live log, the tail is signed by the next checkpoint. See TestVerifyLiveLog */
+		{"unsigned tail", func() [][]byte { return writeLog(t, kp, 10, 4, false) }, pub, false, false, false},
+		{"no checkpoints", func() [][]byte { return writeLog(t, kp, 5, 0, false) }, pub, false, true, false},
+		/* looks the same as a live log, so it is only a Warning */
+		{"truncated tail", func() [][]byte { l := signed(); return l[:len(l)-1] }, pub, false, false, false},
+		{"truncated head", func() [][]byte { return signed()[5:] }, pub, false, true, false},
+		{"rotated head", func() [][]byte { return signed()[5:] }, pub, true, false, false},
+		{"removed record", func() [][]byte {
+			l := signed()
+			return append(l[:2:2], l[3:]...)
+		}, pub, false, true, false},
+		{"reordered records", func() [][]byte {
+			l := signed()
+			l[1], l[2] = l[2], l[1]
+			return l
+		}, pub, false, true, false},
+		{"tampered record", func() [][]byte {
+			l := signed()
+			l[1] = bytes.Replace(l[1], []byte("data/00"), []byte("data/01"), 1)
+			return l
+		}, pub, false, true, false},
+		{"garbage record", func() [][]byte {
+			l := signed()
+			l[1] = []byte("{not json")
+			return l
+		}, pub, false, true, false},
+		{"rebuilt chain with forged checkpoint", func() [][]byte {
+			/* a attacker can rewrite the whole chain, but can only sign it with their own key */
+			return writeLog(t, other, 10, 4, true)
+		}, pub, false, true, false},
+		{"forged checkpoint naming our key", func() [][]byte {
+			l := writeLog(t, other, 10, 4, true)
+			var rec Record
+			if err := json.Unmarshal(l[len(l)-1], &rec); err != nil {
+				t.Fatal(err)
+			}
+			rec.Key = pub
+			sig, _ := other.Sign(checkpointPayload(rec.Seq, rec.Prev))
+			rec.Signature = base64.StdEncoding.EncodeToString(sig)
+			l[len(l)-1], _ = json.Marshal(rec)
+			return l
+		}, pub, false, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := saveLog(t, tt.lines())
+			report, err := Verify([]string{file}, tt.key, tt.rotated)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify error = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if (len(report.Breaks) > 0) != tt.wantBreaks {
+				t.Errorf("Verify Breaks = %s, want Breaks %t", strings.Join(report.Breaks, "; "), tt.wantBreaks)
+			}
+		})
+	}
+}
+
+func TestVerifyRotatedFiles(t *testing.T) {
+	kp, _ := nkeys.CreateServer()
+	pub, _ := kp.PublicKey()
+	lines := writeLog(t, kp, 10, 4, true)
+	older := saveLog(t, lines[:5])
+	current := saveLog(t, lines[5:])
+
+	report, err := Verify([]string{older, current}, pub, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Breaks) > 0 || report.Records != len(lines) || report.Checkpoints != 3 {
+		t.Errorf("Verify = %+v, want %d Records, 3 Checkpoints and no Breaks", report, len(lines))
+	}
+
+	/* out of order files break the chain */
+	report, err = Verify([]string{current, older}, pub, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Breaks) == 0 {
+		t.Errorf("Verify of files out of order reported no Breaks")
+	}
+}
+
+func TestVerifyLiveLog(t *testing.T) {
+	kp, _ := nkeys.CreateServer()
+	pub, _ := kp.PublicKey()
+	/* 10 records with a checkpoint after every 4: the last 2 are not signed yet */
+	file := saveLog(t, writeLog(t, kp, 10, 4, false))
+
+	report, err := Verify([]string{file}, pub, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Breaks) > 0 || report.Checkpoints != 2 || report.Unsigned != 2 {
+		t.Errorf("Verify = %+v, want 2 Checkpoints, 2 Unsigned and no Breaks", report)
+	}
+	if len(report.Warnings) != 1 {
+		t.Errorf("Verify Warnings = %q, want a Warning for the unsigned Records", report.Warnings)
+	}
+}
@@ -1,6 +1,9 @@
 package localfs
 
 import (
+	"bytes"
+	"context"
+	"io"
 	"io/fs"
 	"io/ioutil"
 	"os"
@@ -8,11 +11,24 @@ import (
 	"path/filepath"
 
 	"github.com/Fishwaldo/restic-nats"
+	"github.com/Fishwaldo/restic-nats-server/internal"
+	"github.com/Fishwaldo/restic-nats-server/internal/tracing"
 
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func FSStat(repo string) (fs.FileInfo, error) {
+/* writes are split into blocks of this size, so we can check if the request
+ * was canceled in between */
+const ioBlockSize = 1024 * 1024
+
+func FSStat(ctx context.Context, repo string) (fi fs.FileInfo, err error) {
+	ctx, span := tracing.StartSpan(ctx, "localfs.Stat", attribute.String("path", repo))
+	defer func() { tracing.EndSpan(span, err) }()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	pwd, _ := os.Getwd()
 	fs, err := os.Stat(path.Join(pwd, "repo", repo))
 	if err != nil {
@@ -21,12 +37,22 @@ func FSStat(repo string) (fs.FileInfo, error) {
 	return fs, nil
 }
 
-func FSMkDir(dir string) (error) {
+func FSMkDir(ctx context.Context, dir string) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "localfs.Mkdir", attribute.String("path", dir))
+	defer func() { tracing.EndSpan(span, err) }()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	pwd, _ := os.Getwd()
 	return os.MkdirAll(path.Join(pwd, "repo", dir), 0700)
 }
 
-func FSSave(file string, data *[]byte) (int, error) {
+func FSSave(ctx context.Context, file string, data *[]byte) (written int, err error) {
+	ctx, span := tracing.StartSpan(ctx, "localfs.Save", attribute.String("path", file), attribute.Int("size", len(*data)))
+	defer func() { tracing.EndSpan(span, err) }()
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
 	pwd, _ := os.Getwd()
 	filename := path.Join(pwd, "repo", file)
 	tmpname := filepath.Base(filename) + "-tmp-"
@@ -45,20 +71,33 @@ func FSSave(file string, data *[]byte) (int, error) {
 		}
 	}(f)
 
-	len, err := f.Write(*data)
-	if err != nil {
-		return 0, errors.Wrap(err, "Write Failed")
+	for written < len(*data) {
+		if err = ctx.Err(); err != nil {
+			return 0, errors.Wrap(err, "Write Canceled")
+		}
+		end := written + ioBlockSize
+		if end > len(*data) {
+			end = len(*data)
+		}
+		var n int
+		n, err = f.Write((*data)[written:end])
+		written += n
+		if err != nil {
+			return 0, errors.Wrap(err, "Write Failed")
+		}
 	}
-	if err := f.Close(); err != nil {
+	if err = f.Close(); err != nil {
 		return 0, errors.Wrap(err, "Close")
 	}
-	if err := os.Rename(f.Name(), filename); err != nil {
+	if err = os.Rename(f.Name(), filename); err != nil {
 		return 0, errors.Wrap(err, "Rename")
 	}
-	return len, nil
+	return written, nil
 }
 
-func FSListFiles(dir string, recursive bool) ([]rns.FileInfo, error) {
+func FSListFiles(ctx context.Context, dir string, recursive bool) (result []rns.FileInfo, err error) {
+	ctx, span := tracing.StartSpan(ctx, "localfs.List", attribute.String("path", dir))
+	defer func() { tracing.EndSpan(span, err) }()
 	pwd, _ := os.Getwd()
 	finaldir := path.Join(pwd, "repo", dir)	
 
@@ -73,11 +112,13 @@ func FSListFiles(dir string, recursive bool) ([]rns.FileInfo, error) {
 		return nil, err
 	}
 
-	var result []rns.FileInfo
 	for _, fi := range sub {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		if fi.IsDir() {
 			/* dont' recursive more than 1 level */
-			test, err := FSListFiles(path.Join(dir, fi.Name()), false)
+			test, err := FSListFiles(ctx, path.Join(dir, fi.Name()), false)
 			if err != nil {
 				return nil, err
 			}
@@ -90,17 +131,116 @@ func FSListFiles(dir string, recursive bool) ([]rns.FileInfo, error) {
 	return result, nil
 }
 
-func FSLoadFile(filename string) (*os.File, error) {
+func FSLoadFile(ctx context.Context, filename string) (*File, error) {
+	/* the span covers reading the file too, so its ended by File.Close */
+	ctx, span := tracing.StartSpan(ctx, "localfs.Load", attribute.String("path", filename))
+	if err := ctx.Err(); err != nil {
+		tracing.EndSpan(span, err)
+		return nil, err
+	}
 	pwd, _ := os.Getwd()
 	finalname := path.Join(pwd, "repo", filename)
 	fs, err := os.Open(finalname)
 	if err != nil {
-		return nil, errors.Wrap(err, "LoadFile")
+		err = errors.Wrap(err, "LoadFile")
+		tracing.EndSpan(span, err)
+		return nil, err
 	}
-	return fs, nil
+	return &File{File: fs, ctx: ctx, span: span}, nil
 }
-func FSRemove(filename string) error {
+func FSRemove(ctx context.Context, filename string) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "localfs.Remove", attribute.String("path", filename))
+	defer func() { tracing.EndSpan(span, err) }()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	pwd, _ := os.Getwd()
 	finalname := path.Join(pwd, "repo", filename)
 	return os.Remove(finalname)
+}
+
+// FSSize returns the total size of the files in a Repository
+func FSSize(ctx context.Context, repo string) (size int64, err error) {
+	ctx, span := tracing.StartSpan(ctx, "localfs.Size", attribute.String("path", repo))
+	defer func() { tracing.EndSpan(span, err) }()
+	pwd, _ := os.Getwd()
+	err = filepath.WalkDir(path.Join(pwd, "repo", repo), func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			/* removed while we were walking */
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		size += fi.Size()
+		return nil
+	})
+	return size, errors.Wrap(err, "Size of Repo Failed")
+}
+
+// FSProbe checks a file can be written to the Repository directory, read back and removed
+func FSProbe(ctx context.Context) error {
+	name := ".rns-probe-" + internal.RandString(8)
+	data := []byte("rns readiness probe")
+	if _, err := FSSave(ctx, name, &data); err != nil {
+		return errors.Wrap(err, "Write")
+	}
+	rd, err := FSLoadFile(ctx, name)
+	if err != nil {
+		_ = FSRemove(ctx, name)
+		return errors.Wrap(err, "Read")
+	}
+	readback, err := io.ReadAll(rd)
+	rd.Close()
+	if err == nil && !bytes.Equal(readback, data) {
+		err = errors.New("Data does not match")
+	}
+	if err != nil {
+		_ = FSRemove(ctx, name)
+		return errors.Wrap(err, "Read")
+	}
+	return errors.Wrap(FSRemove(ctx, name), "Remove")
+}
+
+// File is a file opened by FSLoadFile. Reads fail once the context is canceled
+type File struct {
+	*os.File
+	ctx  context.Context
+	span trace.Span
+	read int
+	err  error
+}
+
+func (f *File) Read(p []byte) (int, error) {
+	if err := f.ctx.Err(); err != nil {
+		f.err = err
+		return 0, err
+	}
+	n, err := f.File.Read(p)
+	f.read += n
+	if err != nil && err != io.EOF {
+		f.err = err
+	}
+	return n, err
+}
+
+func (f *File) Close() error {
+	err := f.File.Close()
+	f.span.SetAttributes(attribute.Int("bytes", f.read))
+	if f.err != nil {
+		tracing.EndSpan(f.span, f.err)
+	} else {
+		tracing.EndSpan(f.span, err)
+	}
+	return err
 }
\ No newline at end of file
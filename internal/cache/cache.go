@@ -11,8 +11,13 @@ import (
 	"github.com/Fishwaldo/go-logadapter"
 
 	"github.com/Fishwaldo/restic-nats-server/internal"
+	"github.com/Fishwaldo/restic-nats-server/internal/health"
+	"github.com/Fishwaldo/restic-nats-server/internal/metrics"
 	"github.com/buraksezer/olric"
 	"github.com/buraksezer/olric/config"
+	"github.com/buraksezer/olric/stats"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/viper"
 )
 
@@ -66,9 +71,70 @@ func Start() {
 	if err != nil {
 		log.Fatal("olric.NewDMap returned an error: %v", err)
 	}
+	registerMetrics()
+	health.RegisterReadiness("cache", ready)
+}
+
+//ready checks the Olric cluster is answering requests
+func ready(ctx context.Context) error {
+	if _, err := db.Stats(); err != nil {
+		return errors.Wrap(err, "Stats")
+	}
+	return nil
+}
+
+//registerMetrics exports the cache hit and miss counts to Prometheus
+func registerMetrics() {
+	metrics.Register(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: "rns", Subsystem: "cache", Name: "hits_total",
+		Help: "Cache lookups that found a entry",
+	}, func() float64 { return float64(cacheStats().GetHits) }))
+	metrics.Register(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: "rns", Subsystem: "cache", Name: "misses_total",
+		Help: "Cache lookups that did not find a entry",
+	}, func() float64 { return float64(cacheStats().GetMisses) }))
+}
+
+func cacheStats() stats.DMaps {
+	st, err := db.Stats()
+	if err != nil {
+		log.Warn("Can't get Cache Stats: %s", err)
+		return stats.DMaps{}
+	}
+	return st.DMaps
+}
+
+// ErrNotFound is returned by Get when the key is not in the Cache
+var ErrNotFound = errors.New("Key Not Found")
+
+// ErrNotRunning is returned when the Cache Server has not been started
+var ErrNotRunning = errors.New("Cache Server Not Running")
+
+// Get returns the value stored for key
+func Get(key string) (interface{}, error) {
+	if CacheDM == nil {
+		return nil, ErrNotRunning
+	}
+	value, err := CacheDM.Get(key)
+	if errors.Is(err, olric.ErrKeyNotFound) {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+// PutEx stores value for key, expiring it after timeout
+func PutEx(key string, value interface{}, timeout time.Duration) error {
+	if CacheDM == nil {
+		return ErrNotRunning
+	}
+	return CacheDM.PutEx(key, value, timeout)
 }
 
 func Shutdown() {
+	if db == nil {
+		return
+	}
+	log.Info("Shuting Down Cache Server")
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	err := db.Shutdown(ctx)
 	if err != nil {
@@ -3,7 +3,10 @@
 package cache
 
 import (
+	"time"
+
 	"github.com/Fishwaldo/go-logadapter"
+	"github.com/pkg/errors"
 
 	"github.com/Fishwaldo/restic-nats-server/internal"
 )
@@ -17,6 +20,22 @@ func Start() {
 
 var CacheDM *interface{}
 
+// ErrNotFound is returned by Get when the key is not in the Cache
+var ErrNotFound = errors.New("Key Not Found")
+
+// ErrNotRunning is returned when the Cache Server has not been started
+var ErrNotRunning = errors.New("Cache Server Not Running")
+
+// Get returns the value stored for key
+func Get(key string) (interface{}, error) {
+	return nil, ErrNotRunning
+}
+
+// PutEx stores value for key, expiring it after timeout
+func PutEx(key string, value interface{}, timeout time.Duration) error {
+	return ErrNotRunning
+}
+
 
 func Shutdown() {
 
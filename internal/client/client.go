@@ -1,35 +1,181 @@
 package client
 
 import (
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Fishwaldo/restic-nats"
 	"github.com/Fishwaldo/restic-nats-server/internal"
+	"github.com/Fishwaldo/restic-nats-server/internal/hosts"
 	"github.com/pkg/errors"
 )
 
+// Session is a open Repository, and the Host User that opened it
+type Session struct {
+	rns.Client
+	//Account - the Account the Host User connected to
+	Account string
+	User    string
+	//Hostname - the hostname the client gave when it opened the Session
+	Hostname string
+	Role     hosts.Role
+	//ReadOnly - the client only intends to read from the Repository
+	ReadOnly bool
+}
+
+// SessionOption sets additional details on a Session when its created
+type SessionOption func(*Session)
+
+// WithUser records the Host User that opened the Session
+func WithUser(user string) SessionOption {
+	return func(s *Session) {
+		s.User = user
+	}
+}
+
+// WithAccount records the Account of the Host User that opened the Session
+func WithAccount(account string) SessionOption {
+	return func(s *Session) {
+		s.Account = account
+	}
+}
+
+// WithHostname records the hostname the client gave when it opened the Session
+func WithHostname(hostname string) SessionOption {
+	return func(s *Session) {
+		s.Hostname = hostname
+	}
+}
+
+// WithRole records the Role the Session is permitted to act with
+func WithRole(role hosts.Role) SessionOption {
+	return func(s *Session) {
+		s.Role = role
+	}
+}
+
+// WithReadOnly records that the client only intends to read from the Repository
+func WithReadOnly(readonly bool) SessionOption {
+	return func(s *Session) {
+		s.ReadOnly = readonly
+	}
+}
+
+//sessionEntry is a Session in clientList, and when it was last used
+type sessionEntry struct {
+	//lastActive - unix nanoseconds, updated atomically. First so its 64 bit aligned
+	lastActive int64
+	Session
+}
+
+func (e *sessionEntry) touch(now time.Time) {
+	atomic.StoreInt64(&e.lastActive, now.UnixNano())
+}
+
+func (e *sessionEntry) idleSince(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&e.lastActive)))
+}
+
+/* Sessions are only held in this process. Workers in a queue group each have
+ * their own list, so the ClientID starts with the nodeID of the Worker that
+ * opened it, and other Workers forward the Session's requests to that Worker */
 var clientList sync.Map
 
-func Create(or rns.OpenRepoOp) (rns.Client, error) {
-	client := rns.Client{ClientID: internal.RandString(16), Bucket: or.Bucket}
-	clientList.Store(client.ClientID, client)
-	return client, nil
+//nodeID identifies this process in the ClientIDs it hands out
+var nodeID = internal.RandString(8)
+
+// NodeID returns the identity of this process, that Sessions opened here are owned by
+func NodeID() string {
+	return nodeID
+}
+
+// Owner returns the NodeID of the process that opened a Session, or "" if the ClientID doesn't name one
+func Owner(clientid string) string {
+	if i := strings.IndexByte(clientid, '-'); i > 0 {
+		return clientid[:i]
+	}
+	return ""
+}
+
+func Create(or rns.OpenRepoOp, opts ...SessionOption) (Session, error) {
+	session := Session{Client: rns.Client{ClientID: nodeID + "-" + internal.RandString(16), Bucket: or.Bucket}}
+	for _, opt := range opts {
+		opt(&session)
+	}
+	if err := acquire(session.Account, session.User, session.Bucket); err != nil {
+		return Session{}, err
+	}
+	entry := &sessionEntry{Session: session}
+	entry.touch(time.Now())
+	clientList.Store(session.ClientID, entry)
+	return session, nil
 }
 
 func Find(clientid string) (rns.Client, error) {
-	client, found := clientList.Load(clientid)
+	session, err := FindSession(clientid)
+	if err != nil {
+		return rns.Client{}, err
+	}
+	return session.Client, nil
+}
+
+//FindSession returns the Session, and records it as active so it doesn't expire
+func FindSession(clientid string) (Session, error) {
+	entry, found := clientList.Load(clientid)
 	if !found {
-		return rns.Client{}, errors.New("Client Not Found")
+		return Session{}, errors.New("Client Not Found")
 	}
-	return client.(rns.Client), nil
+	entry.(*sessionEntry).touch(time.Now())
+	return entry.(*sessionEntry).Session, nil
 }
 
 func Remove(clientid string) (error) {
-	_, found := clientList.Load(clientid)
+	entry, found := clientList.LoadAndDelete(clientid)
 	if found {
-		clientList.Delete(clientid)
+		session := entry.(*sessionEntry).Session
+		release(session.Account, session.User, session.Bucket)
 		return nil
 	} else {
 		return errors.New("Client Not Found")
 	}
-}
\ No newline at end of file
+}
+
+// ExpireIdle closes Sessions that have not been used for sessions.idletimeout, and returns them
+func ExpireIdle(now time.Time) []Session {
+	if limitsConfig.IdleTimeout <= 0 {
+		return nil
+	}
+	return expireIdle(now, limitsConfig.IdleTimeout)
+}
+
+//expireIdle removes Sessions that have not been used for idle, returning them
+func expireIdle(now time.Time, idle time.Duration) []Session {
+	var expired []Session
+	clientList.Range(func(key, value interface{}) bool {
+		entry := value.(*sessionEntry)
+		if entry.idleSince(now) < idle {
+			return true
+		}
+		/* only release the slot if a Close didn't beat us to it */
+		if _, found := clientList.LoadAndDelete(key); found {
+			release(entry.Account, entry.User, entry.Bucket)
+			expired = append(expired, entry.Session)
+		}
+		return true
+	})
+	return expired
+}
+
+// RemoveAll closes every open Session, returning how many were closed
+func RemoveAll() int {
+	var count int
+	clientList.Range(func(key, value interface{}) bool {
+		if Remove(key.(string)) == nil {
+			count++
+		}
+		return true
+	})
+	return count
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	rns "github.com/Fishwaldo/restic-nats"
+)
+
+func TestExpireIdle(t *testing.T) {
+	defer RemoveAll()
+	idle, err := Create(rns.OpenRepoOp{Bucket: "repo1"}, WithUser("host1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	active, err := Create(rns.OpenRepoOp{Bucket: "repo1"}, WithUser("host1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Add(time.Hour)
+	entry, _ := clientList.Load(active.ClientID)
+	entry.(*sessionEntry).touch(now.Add(-time.Minute))
+
+	expired := expireIdle(now, 30*time.Minute)
+	if len(expired) != 1 || expired[0].ClientID != idle.ClientID {
+		t.Fatalf("expireIdle expired %v, want only %s", expired, idle.ClientID)
+	}
+	if _, found := clientList.Load(idle.ClientID); found {
+		t.Errorf("Expired Session %s can still be found", idle.ClientID)
+	}
+	if _, found := clientList.Load(active.ClientID); !found {
+		t.Errorf("Active Session %s was expired", active.ClientID)
+	}
+	counts := Counts()
+	if counts.Total != 1 || counts.Repos["repo1"] != 1 {
+		t.Errorf("Counts after expiry = %+v, want 1 Session on repo1", counts)
+	}
+	if expired := expireIdle(now, 30*time.Minute); len(expired) != 0 {
+		t.Errorf("Second expireIdle expired %v, want none", expired)
+	}
+}
+
+func TestOwner(t *testing.T) {
+	defer RemoveAll()
+	session, err := Create(rns.OpenRepoOp{Bucket: "repo1"}, WithUser("host1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := Owner(session.ClientID); got != NodeID() {
+		t.Errorf("Owner(%q) = %q, want %q", session.ClientID, got, NodeID())
+	}
+	for _, clientid := range []string{"", "abcdefgh", "-abcdefgh"} {
+		if got := Owner(clientid); got != "" {
+			t.Errorf("Owner(%q) = %q, want none", clientid, got)
+		}
+	}
+}
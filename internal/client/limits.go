@@ -0,0 +1,163 @@
+package client
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/Fishwaldo/restic-nats-server/internal"
+	"github.com/Fishwaldo/restic-nats-server/internal/hosts"
+	"github.com/Fishwaldo/restic-nats-server/internal/metrics"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// ErrSessionLimit is returned when opening a Session would exceed the configured limits
+var ErrSessionLimit = errors.New("Session Limit Reached")
+
+//defaultIdleTimeout - restic refreshes its locks every 5 minutes, so a Session idle for
+//much longer than that belongs to a client that has gone away
+const defaultIdleTimeout = 30 * time.Minute
+
+type limitsConfigT struct {
+	MaxPerHost int
+	MaxPerRepo int
+	Repos      map[string]int
+	//IdleTimeout - Sessions not used for this long are closed, releasing their slots. 0 never closes them
+	IdleTimeout time.Duration
+}
+
+var limitsConfig = limitsConfigT{IdleTimeout: defaultIdleTimeout}
+
+// SessionCounts is the number of open Sessions, in total and per Host User and Repository
+type SessionCounts struct {
+	Total int            `json:"total"`
+	Hosts map[string]int `json:"hosts"`
+	Repos map[string]int `json:"repos"`
+}
+
+var (
+	hostCount = make(map[string]int)
+	repoCount = make(map[string]int)
+	countMx   sync.Mutex
+)
+
+func init() {
+	internal.ConfigRegister("sessions", parseConfig, validateConfig)
+	viper.SetDefault("sessions.maxperhost", 0)
+	viper.SetDefault("sessions.maxperrepo", 0)
+	viper.SetDefault("sessions.idletimeout", defaultIdleTimeout)
+	expvar.Publish("sessions", expvar.Func(func() interface{} { return Counts() }))
+}
+
+func parseConfig(cfg *viper.Viper) error {
+	limitsConfig.MaxPerHost = cfg.GetInt("maxperhost")
+	limitsConfig.MaxPerRepo = cfg.GetInt("maxperrepo")
+	/* viper.Sub drops the defaults if the section exists */
+	limitsConfig.IdleTimeout = defaultIdleTimeout
+	if cfg.IsSet("idletimeout") {
+		limitsConfig.IdleTimeout = cfg.GetDuration("idletimeout")
+	}
+	if err := cfg.UnmarshalKey("repos", &limitsConfig.Repos); err != nil {
+		return errors.Wrap(err, "sessions parseConfig")
+	}
+	for repo := range limitsConfig.Repos {
+		metrics.AddRepo(repo)
+	}
+	return nil
+}
+
+func validateConfig() (warnings []error, err error) {
+	if limitsConfig.MaxPerHost < 0 || limitsConfig.MaxPerRepo < 0 {
+		return nil, errors.New("Session Limits can not be negative")
+	}
+	for repo, max := range limitsConfig.Repos {
+		if max < 0 {
+			return nil, errors.Errorf("Session Limit for Repository %s can not be negative", repo)
+		}
+	}
+	if limitsConfig.IdleTimeout < 0 {
+		return nil, errors.New("sessions.idletimeout can not be negative")
+	}
+	return nil, nil
+}
+
+func hostLimit(account, user string) int {
+	if max := hosts.Find(account, user).MaxSessions; max > 0 {
+		return max
+	}
+	return limitsConfig.MaxPerHost
+}
+
+func repoLimit(repo string) int {
+	if max, ok := limitsConfig.Repos[repo]; ok && max > 0 {
+		return max
+	}
+	return limitsConfig.MaxPerRepo
+}
+
+// checkLimits must be called with countMx held
+func checkLimits(account, user, repo string) error {
+	name := hosts.Name(account, user)
+	if max := hostLimit(account, user); max > 0 && hostCount[name] >= max {
+		return errors.Wrapf(ErrSessionLimit, "Host %s has %d Sessions Open", name, hostCount[name])
+	}
+	if max := repoLimit(repo); max > 0 && repoCount[repo] >= max {
+		return errors.Wrapf(ErrSessionLimit, "Repository %s has %d Sessions Open", repo, repoCount[repo])
+	}
+	return nil
+}
+
+// IdleTimeout is how long a Session can go unused before its closed. 0 if they never are
+func IdleTimeout() time.Duration {
+	return limitsConfig.IdleTimeout
+}
+
+// CheckLimits reports if a Host User could open another Session on a Repository
+func CheckLimits(account, user, repo string) error {
+	countMx.Lock()
+	defer countMx.Unlock()
+	return checkLimits(account, user, repo)
+}
+
+// acquire reserves a Session slot for the Host User and Repository
+func acquire(account, user, repo string) error {
+	countMx.Lock()
+	defer countMx.Unlock()
+	if err := checkLimits(account, user, repo); err != nil {
+		return err
+	}
+	hostCount[hosts.Name(account, user)]++
+	repoCount[repo]++
+	metrics.Sessions.WithLabelValues(metrics.RepoLabel(repo)).Inc()
+	return nil
+}
+
+// release frees a Session slot for the Host User and Repository
+func release(account, user, repo string) {
+	name := hosts.Name(account, user)
+	countMx.Lock()
+	defer countMx.Unlock()
+	if hostCount[name]--; hostCount[name] <= 0 {
+		delete(hostCount, name)
+	}
+	if repoCount[repo]--; repoCount[repo] <= 0 {
+		delete(repoCount, repo)
+	}
+	metrics.Sessions.WithLabelValues(metrics.RepoLabel(repo)).Dec()
+}
+
+// Counts returns the number of currently open Sessions
+func Counts() SessionCounts {
+	countMx.Lock()
+	defer countMx.Unlock()
+	sc := SessionCounts{Hosts: make(map[string]int), Repos: make(map[string]int)}
+	for user, count := range hostCount {
+		sc.Hosts[user] = count
+		sc.Total += count
+	}
+	for repo, count := range repoCount {
+		sc.Repos[repo] = count
+	}
+	return sc
+}
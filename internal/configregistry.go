@@ -11,6 +11,8 @@ type configRegistryT struct {
 }
 
 var cfgReg map[string]configRegistryT
+/* Sections are parsed and validated in the order they were registered */
+var cfgOrder []string
 
 func init() {
 	cfgReg = make(map[string]configRegistryT)
@@ -23,14 +25,13 @@ func ConfigRegister(name string, parse func( *viper.Viper) (error), validate fun
 		return errors.New("config Section Already Registered")
 	}
 	cfgReg[name] = configRegistryT{parse: parse, validate: validate}
+	cfgOrder = append(cfgOrder, name)
 	return nil
 }
 
 func ConfigGetSections() []string {
-	var ret []string
-	for key := range cfgReg {
-		ret = append(ret, key)
-	}
+	ret := make([]string, len(cfgOrder))
+	copy(ret, cfgOrder)
 	return ret
 }
 
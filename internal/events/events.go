@@ -0,0 +1,191 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Fishwaldo/go-logadapter"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+
+	"github.com/Fishwaldo/restic-nats-server/internal"
+)
+
+var log logadapter.Logger
+
+// Type is the kind of Event
+type Type string
+
+//Event Types
+const (
+	SessionOpened Type = "session.opened"
+	SessionClosed Type = "session.closed"
+	SnapshotSaved Type = "snapshot.saved"
+	LockCreated   Type = "lock.created"
+	LockRemoved   Type = "lock.removed"
+	LockStale     Type = "lock.stale"
+	FileDeleted   Type = "file.deleted"
+	SaveFailed    Type = "save.failed"
+	//QuotaThreshold - the Repository has grown past events.quotathreshold
+	QuotaThreshold Type = "quota.threshold"
+)
+
+//defaultStaleLockAge is how old a lock is before its reported as stale. restic
+//refreshes its locks every 5 minutes, and treats them as stale after 30
+const defaultStaleLockAge = 30 * time.Minute
+
+// Event is published when something happens to a Repository
+type Event struct {
+	Type    Type      `json:"type"`
+	Time    time.Time `json:"time"`
+	Account string    `json:"account,omitempty"`
+	User    string    `json:"user,omitempty"`
+	//Hostname - the hostname the client gave when it opened the Session
+	Hostname string `json:"hostname,omitempty"`
+	Session  string `json:"session,omitempty"`
+	Repo     string `json:"repo"`
+	//Path - the file, relative to the Repository
+	Path  string `json:"path,omitempty"`
+	Bytes int64  `json:"bytes,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Listener is called with every Event, whether or not it is published on NATS
+type Listener func(ev Event)
+
+type eventsConfigT struct {
+	//Subject - events are published to <subject>.<account>.<repo>.<type>. The account
+	//and repo are escaped with subjectToken
+	Subject string
+	//StaleLockAge - locks older than this are reported as stale. 0 disables
+	StaleLockAge time.Duration
+	//QuotaThreshold - Repository size in bytes that is reported when its crossed. 0 disables
+	QuotaThreshold int64
+}
+
+var eventsConfig eventsConfigT
+
+var (
+	mx        sync.RWMutex
+	nc        *nats.Conn
+	listeners []Listener
+)
+
+func init() {
+	log = internal.Log.New("events")
+	viper.SetDefault("events.stalelockage", defaultStaleLockAge.String())
+	eventsConfig.StaleLockAge = defaultStaleLockAge
+	internal.ConfigRegister("events", parseConfig, validateConfig)
+}
+
+func parseConfig(cfg *viper.Viper) error {
+	eventsConfig.Subject = strings.TrimSuffix(cfg.GetString("subject"), ".")
+	/* viper.Sub drops the defaults if the section exists */
+	if cfg.IsSet("stalelockage") {
+		eventsConfig.StaleLockAge = cfg.GetDuration("stalelockage")
+	}
+	/* accepts sizes like 100GB */
+	eventsConfig.QuotaThreshold = int64(cfg.GetSizeInBytes("quotathreshold"))
+	return nil
+}
+
+func validateConfig() (warnings []error, err error) {
+	if strings.ContainsAny(eventsConfig.Subject, "*> \t") {
+		return nil, errors.Errorf("Invalid events.subject %s", eventsConfig.Subject)
+	}
+	if eventsConfig.StaleLockAge < 0 {
+		return nil, errors.New("events.stalelockage can not be negative")
+	}
+	return nil, nil
+}
+
+// StaleLockAge returns how old a lock is before its reported as stale, or 0 if disabled
+func StaleLockAge() time.Duration {
+	return eventsConfig.StaleLockAge
+}
+
+// QuotaThresholdBytes returns the Repository size that is reported when its crossed, or 0 if disabled
+func QuotaThresholdBytes() int64 {
+	return eventsConfig.QuotaThreshold
+}
+
+// AddListener registers a function that is called with every Event
+func AddListener(l Listener) {
+	mx.Lock()
+	defer mx.Unlock()
+	listeners = append(listeners, l)
+}
+
+// Subject returns the prefix events are published under, or empty if events are disabled
+func Subject() string {
+	return eventsConfig.Subject
+}
+
+// SetConn sets the NATS connection used to publish events, if events.subject is configured
+func SetConn(conn *nats.Conn) {
+	if eventsConfig.Subject == "" {
+		return
+	}
+	mx.Lock()
+	defer mx.Unlock()
+	nc = conn
+	log.Info("Publishing Repository Events to %s", eventsConfig.Subject)
+}
+
+// AccountSubject returns the subjects the events of a Account are published to
+func AccountSubject(account string) string {
+	return fmt.Sprintf("%s.%s.>", eventsConfig.Subject, subjectToken(account))
+}
+
+//subjectToken escapes name so its a single token in a Subject. Characters NATS
+//treats specially, and %, are replaced with %XX. Empty names become _
+func subjectToken(name string) string {
+	if name == "" {
+		return "_"
+	}
+	var sb strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c <= ' ' || c == 0x7f || strings.IndexByte(".*>%", c) >= 0 {
+			fmt.Fprintf(&sb, "%%%02X", c)
+			continue
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String()
+}
+
+// Publish sends a Event to the Listeners and NATS. Failures are logged, as events are best effort
+func Publish(ev Event) {
+	mx.RLock()
+	defer mx.RUnlock()
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	for _, l := range listeners {
+		l(ev)
+	}
+	if nc == nil {
+		return
+	}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		log.Warn("Can't Encode Event: %s", err)
+		return
+	}
+	subject := fmt.Sprintf("%s.%s.%s.%s", eventsConfig.Subject, subjectToken(ev.Account), subjectToken(ev.Repo), ev.Type)
+	if err := nc.Publish(subject, data); err != nil {
+		log.Warn("Event Publish to %s Failed: %s", subject, err)
+	}
+}
+
+// Shutdown stops publishing events
+func Shutdown() {
+	mx.Lock()
+	defer mx.Unlock()
+	nc = nil
+}
@@ -0,0 +1,35 @@
+package events
+
+import "testing"
+
+func TestSubjectToken(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"repo1", "repo1"},
+		{"my-repo_2", "my-repo_2"},
+		{"", "_"},
+		{"repo.1", "repo%2E1"},
+		{"*", "%2A"},
+		{">", "%3E"},
+		{"a b\tc", "a%20b%09c"},
+		{"50%", "50%25"},
+		{"line\nbreak", "line%0Abreak"},
+		{"héllo", "héllo"},
+	}
+	for _, tt := range tests {
+		if got := subjectToken(tt.name); got != tt.want {
+			t.Errorf("subjectToken(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAccountSubject(t *testing.T) {
+	defer func(subject string) { eventsConfig.Subject = subject }(eventsConfig.Subject)
+	eventsConfig.Subject = "rns.events"
+	/* must match the subjects Publish uses for the Account */
+	if got, want := AccountSubject("my.office"), "rns.events.my%2Eoffice.>"; got != want {
+		t.Errorf("AccountSubject = %q, want %q", got, want)
+	}
+}
@@ -3,6 +3,7 @@ package internal
 import (
 	"net/url"
 	"sync"
+	"time"
 
 	rns "github.com/Fishwaldo/restic-nats"
 	"github.com/nats-io/nats.go"
@@ -10,9 +11,28 @@ import (
 )
 
 
+type PoolConfigT struct {
+	NumWorkers int
+	MinWorkers int
+	MaxWorkers int
+}
+
 type WorkerConfigT struct {
-	NumWorkers  int
-	Connections uint
+	PoolConfigT
+	Bulk           *PoolConfigT
+	ScaleInterval  time.Duration
+	TargetWait     time.Duration
+	ShutdownGrace  time.Duration
+	Connections    uint
+	DefaultTimeout time.Duration
+	Timeouts       map[rns.NatsCommand]time.Duration
+	Handles        []string
+	Accounts       []string
+	DedupeWindow   time.Duration
+	DedupeStore    string
+	QueueSize      int
+	PendingMsgs    int
+	PendingBytes   int
 }
 
 type NatsConfigT struct {
@@ -20,6 +40,10 @@ type NatsConfigT struct {
 	NatsURL            *url.URL
 	NatsNKey           string
 	NatsCredfile       string
+	//NatsTLSCA, NatsTLSCert and NatsTLSKey - for Workers connecting to a Nats Server that requires TLS
+	NatsTLSCA   string
+	NatsTLSCert string
+	NatsTLSKey  string
 }
 
 type GlobalStateT struct {
@@ -27,7 +51,8 @@ type GlobalStateT struct {
 	NatsConfig               NatsConfigT
 	Conn                      *rns.ResticNatsClient
 	ClientCommand 				chan *nats.Msg
-	ClientCommandSubscription *nats.Subscription
+	BulkCommand               chan *nats.Msg
+	ClientCommandSubscriptions []*nats.Subscription
 	Mx                        sync.Mutex
 	T                         tomb.Tomb
 }
@@ -0,0 +1,81 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Fishwaldo/restic-nats-server/internal/httpserver"
+)
+
+//checkTimeout is how long all the checks for a request may take
+const checkTimeout = 5 * time.Second
+
+// Check returns a error if the component is not healthy
+type Check func(ctx context.Context) error
+
+type checkT struct {
+	name  string
+	check Check
+}
+
+var (
+	mx        sync.RWMutex
+	liveness  []checkT
+	readiness []checkT
+)
+
+func init() {
+	httpserver.Handle("/healthz", handler(&liveness, false))
+	httpserver.Handle("/readyz", handler(&readiness, true))
+}
+
+// RegisterLiveness adds a check to /healthz. If it fails, the process should be restarted
+func RegisterLiveness(name string, check Check) {
+	mx.Lock()
+	defer mx.Unlock()
+	liveness = append(liveness, checkT{name: name, check: check})
+}
+
+// RegisterReadiness adds a check to /readyz. If it fails, we can't serve requests
+func RegisterReadiness(name string, check Check) {
+	mx.Lock()
+	defer mx.Unlock()
+	readiness = append(readiness, checkT{name: name, check: check})
+}
+
+type statusT struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+//handler runs the checks. If required is set, we are not healthy until
+//some checks have been registered
+func handler(checks *[]checkT, required bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+		defer cancel()
+		status := statusT{Status: "ok", Checks: make(map[string]string)}
+		mx.RLock()
+		list := append([]checkT(nil), *checks...)
+		mx.RUnlock()
+		if required && len(list) == 0 {
+			status.Status = "starting"
+		}
+		for _, c := range list {
+			if err := c.check(ctx); err != nil {
+				status.Status = "failed"
+				status.Checks[c.name] = err.Error()
+			} else {
+				status.Checks[c.name] = "ok"
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if status.Status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(status)
+	})
+}
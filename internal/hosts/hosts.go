@@ -0,0 +1,122 @@
+package hosts
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+//DefaultAccount is the Account Host Users are placed in if they don't name one
+const DefaultAccount = "Hosts"
+
+// Host is the policy applied to a host user connecting to a Host account
+type Host struct {
+	//Account - The Account the Host User connects to. Empty is the DefaultAccount
+	Account  string
+	Username string
+	//Certificate - the identity in the Host's TLS Client Certificate, when Hosts are
+	//authenticated by Certificate. The Nats Server knows the Host by this name
+	Certificate string
+	Role        Role
+	//MaxSessions - Maximum concurrent Sessions for this Host. 0 uses the default limit
+	MaxSessions int
+	//OpsPerSec - Save and Load operations per second. 0 is unlimited
+	OpsPerSec float64
+	//OpsBurst - How many operations can be sent at once before OpsPerSec applies
+	OpsBurst int
+	//BytesPerSec - Bytes per second transfered by Save and Load. 0 is unlimited
+	BytesPerSec int
+	//BytesBurst - How many bytes can be transfered at once before BytesPerSec applies
+	BytesBurst int
+}
+
+var (
+	hostList = make(map[string]Host)
+	//certList - the Username each Certificate identity is mapped to
+	certList    = make(map[string]string)
+	defaultRole = RoleAdmin
+	mx          sync.RWMutex
+)
+
+// Register adds the policy for a host user
+func Register(h Host) error {
+	if h.Username == "" {
+		return errors.New("Host Username is empty")
+	}
+	if _, err := ParseRole(string(h.Role)); err != nil {
+		return errors.Wrapf(err, "Host %s", h.Username)
+	}
+	if h.MaxSessions < 0 {
+		return errors.Errorf("Host %s: MaxSessions can not be negative", h.Username)
+	}
+	if h.OpsPerSec < 0 || h.OpsBurst < 0 || h.BytesPerSec < 0 || h.BytesBurst < 0 {
+		return errors.Errorf("Host %s: Rate Limits can not be negative", h.Username)
+	}
+	if h.Account == "" {
+		h.Account = DefaultAccount
+	}
+	mx.Lock()
+	defer mx.Unlock()
+	if h.Certificate != "" {
+		cert := Name(h.Account, h.Certificate)
+		if user, found := certList[cert]; found && user != h.Username {
+			return errors.Errorf("Host %s: Certificate %s is already mapped to %s", h.Username, h.Certificate, user)
+		}
+		certList[cert] = h.Username
+	}
+	hostList[Name(h.Account, h.Username)] = h
+	return nil
+}
+
+// Resolve returns the Username of a user the Nats Server authenticated. Hosts
+// authenticated by Certificate are mapped back to their Username
+func Resolve(account, user string) string {
+	if account == "" {
+		account = DefaultAccount
+	}
+	mx.RLock()
+	defer mx.RUnlock()
+	if username, found := certList[Name(account, user)]; found {
+		return username
+	}
+	return user
+}
+
+// Name identifies a host user across Accounts. Users in the DefaultAccount
+// are just their Username, others are account/username
+func Name(account, username string) string {
+	if account == "" || account == DefaultAccount {
+		return username
+	}
+	return account + "/" + username
+}
+
+// SetDefaultRole sets the role given to host users that have no policy registered
+func SetDefaultRole(role Role) error {
+	if _, err := ParseRole(string(role)); err != nil {
+		return err
+	}
+	mx.Lock()
+	defer mx.Unlock()
+	defaultRole = role
+	return nil
+}
+
+// Find returns the policy for a host user in a Account, falling back to the
+// default role if the user has not been registered
+func Find(account, username string) Host {
+	if account == "" {
+		account = DefaultAccount
+	}
+	mx.RLock()
+	defer mx.RUnlock()
+	if h, found := hostList[Name(account, username)]; found {
+		return h
+	}
+	return Host{Account: account, Username: username, Role: defaultRole}
+}
+
+// Name returns the name that identifies the host user across Accounts
+func (h Host) Name() string {
+	return Name(h.Account, h.Username)
+}
@@ -0,0 +1,73 @@
+package hosts
+
+import (
+	"path"
+	"strings"
+
+	rns "github.com/Fishwaldo/restic-nats"
+	"github.com/pkg/errors"
+)
+
+// Role is the set of repository operations a host user is permitted to perform
+type Role string
+
+const (
+	//RoleAdmin - may perform every operation
+	RoleAdmin Role = "admin"
+	//RoleBackup - may create new data and read the repository, but can only remove locks.
+	//restic backup reads the config, keys, index, locks and the trees of the parent snapshot
+	RoleBackup Role = "backup"
+	//RoleRestore - may only read from the repository
+	RoleRestore Role = "restore"
+)
+
+var roleOps = map[Role][]rns.NatsCommand{
+	RoleAdmin: {
+		rns.NatsOpenCmd, rns.NatsStatCmd, rns.NatsMkdirCmd, rns.NatsSaveCmd,
+		rns.NatsListCmd, rns.NatsLoadCmd, rns.NatsRemoveCmd, rns.NatsCloseCmd,
+	},
+	RoleBackup: {
+		rns.NatsOpenCmd, rns.NatsStatCmd, rns.NatsMkdirCmd, rns.NatsSaveCmd,
+		rns.NatsListCmd, rns.NatsLoadCmd, rns.NatsRemoveCmd, rns.NatsCloseCmd,
+	},
+	RoleRestore: {
+		rns.NatsOpenCmd, rns.NatsStatCmd, rns.NatsListCmd, rns.NatsLoadCmd,
+		rns.NatsCloseCmd,
+	},
+}
+
+// ParseRole converts a role name from the config file into a Role
+func ParseRole(name string) (Role, error) {
+	role := Role(strings.ToLower(strings.TrimSpace(name)))
+	if _, ok := roleOps[role]; !ok {
+		return "", errors.Errorf("Unknown Role %s", name)
+	}
+	return role, nil
+}
+
+// Allows reports if the role may perform cmd on file, relative to the repository
+func (r Role) Allows(cmd rns.NatsCommand, file string) bool {
+	for _, op := range roleOps[r] {
+		if op != cmd {
+			continue
+		}
+		/* backup hosts need to clean up their own locks, but nothing else */
+		if cmd == rns.NatsRemoveCmd && r == RoleBackup {
+			return isLockFile(file)
+		}
+		return true
+	}
+	return false
+}
+
+//isLockFile reports if file is a lock directly in the locks directory. Paths
+//that climb out with .. are refused rather than cleaned
+func isLockFile(file string) bool {
+	for _, elem := range strings.Split(file, "/") {
+		if elem == ".." {
+			return false
+		}
+	}
+	dir, name := path.Split(strings.TrimPrefix(path.Clean("/"+file), "/"))
+	return dir == "locks/" && name != ""
+}
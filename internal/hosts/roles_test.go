@@ -0,0 +1,62 @@
+package hosts
+
+import (
+	"testing"
+
+	rns "github.com/Fishwaldo/restic-nats"
+)
+
+func TestRoleAllows(t *testing.T) {
+	tests := []struct {
+		name string
+		role Role
+		cmd  rns.NatsCommand
+		file string
+		want bool
+	}{
+		{"admin save", RoleAdmin, rns.NatsSaveCmd, "data/00/0011", true},
+		{"admin remove data", RoleAdmin, rns.NatsRemoveCmd, "data/00/0011", true},
+		{"backup save", RoleBackup, rns.NatsSaveCmd, "data/00/0011", true},
+		{"backup load", RoleBackup, rns.NatsLoadCmd, "data/00/0011", true},
+		{"backup load config", RoleBackup, rns.NatsLoadCmd, "config", true},
+		{"backup remove lock", RoleBackup, rns.NatsRemoveCmd, "locks/abcd", true},
+		{"backup remove lock with slashes", RoleBackup, rns.NatsRemoveCmd, "/locks//abcd", true},
+		{"backup remove data", RoleBackup, rns.NatsRemoveCmd, "data/00/0011", false},
+		{"backup remove locks dir", RoleBackup, rns.NatsRemoveCmd, "locks/", false},
+		{"backup remove nested lock", RoleBackup, rns.NatsRemoveCmd, "locks/sub/abcd", false},
+		{"backup remove traversal to data", RoleBackup, rns.NatsRemoveCmd, "locks/../data/0011", false},
+		{"backup remove traversal out of repo", RoleBackup, rns.NatsRemoveCmd, "locks/../../other/locks/abcd", false},
+		{"backup remove traversal back to locks", RoleBackup, rns.NatsRemoveCmd, "data/../locks/abcd", false},
+		{"restore load", RoleRestore, rns.NatsLoadCmd, "data/00/0011", true},
+		{"restore save", RoleRestore, rns.NatsSaveCmd, "data/00/0011", false},
+		{"restore remove lock", RoleRestore, rns.NatsRemoveCmd, "locks/abcd", false},
+		{"unknown role", Role("nobody"), rns.NatsOpenCmd, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.role.Allows(tt.cmd, tt.file); got != tt.want {
+				t.Errorf("%s.Allows(%s, %q) = %t, want %t", tt.role, tt.cmd, tt.file, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRole(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Role
+		wantErr bool
+	}{
+		{"admin", RoleAdmin, false},
+		{" Backup ", RoleBackup, false},
+		{"RESTORE", RoleRestore, false},
+		{"", "", true},
+		{"root", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRole(tt.name)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseRole(%q) = %q, %v, want %q, error %t", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package httpserver
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"time"
+
+	"github.com/Fishwaldo/go-logadapter"
+	"github.com/spf13/viper"
+
+	"github.com/Fishwaldo/restic-nats-server/internal"
+)
+
+var log logadapter.Logger
+
+type httpConfigT struct {
+	Listen string
+}
+
+var httpConfig httpConfigT
+
+var (
+	mux = http.NewServeMux()
+	srv *http.Server
+)
+
+func init() {
+	log = internal.Log.New("httpserver")
+	viper.SetDefault("http.listen", "localhost:8082")
+	internal.ConfigRegister("http", parseConfig, validateConfig)
+	mux.Handle("/debug/vars", expvar.Handler())
+}
+
+func parseConfig(cfg *viper.Viper) error {
+	httpConfig.Listen = cfg.GetString("listen")
+	return nil
+}
+
+func validateConfig() (warnings []error, err error) {
+	return nil, nil
+}
+
+// Handle registers a handler on the admin HTTP Server
+func Handle(pattern string, handler http.Handler) {
+	mux.Handle(pattern, handler)
+}
+
+// Handler returns the handler serving everything registered with Handle
+func Handler() http.Handler {
+	return mux
+}
+
+// Start the admin HTTP Server, if a listen address is configured
+func Start() {
+	if httpConfig.Listen == "" {
+		log.Info("Not Starting HTTP Server")
+		return
+	}
+	srv = &http.Server{Addr: httpConfig.Listen, Handler: mux}
+	log.Info("Starting HTTP Server on %s", httpConfig.Listen)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Error("HTTP Server Failed: %s", err)
+		}
+	}()
+}
+
+func Shutdown() {
+	if srv == nil {
+		return
+	}
+	log.Info("Shuting Down HTTP Server")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Warn("HTTP Server Shutdown Failed: %s", err)
+	}
+}
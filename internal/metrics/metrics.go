@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/Fishwaldo/restic-nats-server/internal/httpserver"
+)
+
+const namespace = "rns"
+
+//Result labels for Requests
+const (
+	ResultOk      = "ok"
+	ResultFailed  = "failed"
+	ResultRefused = "refused"
+	ResultExpired = "expired"
+	ResultBusy    = "busy"
+	//ResultForwarded - passed on to the Workers that handle the Repository
+	ResultForwarded = "forwarded"
+)
+
+var (
+	//Requests - Client Commands processed, by Operation, Repository and Result
+	Requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Client Commands processed",
+	}, []string{"op", "repo", "result"})
+
+	//RequestDuration - How long Client Commands take to process
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to process Client Commands",
+		Buckets:   []float64{.001, .005, .01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"op", "repo"})
+
+	//Bytes - File Data received by Save and sent by Load
+	Bytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bytes_total",
+		Help:      "File Data transfered, by direction (in for Save, out for Load)",
+	}, []string{"direction", "repo"})
+
+	//Sessions - Currently open Sessions
+	Sessions = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "sessions",
+		Help:      "Currently open Sessions",
+	}, []string{"repo"})
+
+	//BackendErrors - Errors returned by the storage backend
+	BackendErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backend_errors_total",
+		Help:      "Errors returned by the storage backend",
+	}, []string{"op"})
+
+	//Throttled - Requests refused by the per-host Rate Limits
+	Throttled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "throttled_total",
+		Help:      "Requests refused by the per-host Rate Limits",
+	}, []string{"host"})
+
+	//SlowConsumers - Times NATS dropped messages because we could not keep up
+	SlowConsumers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "slow_consumer_total",
+		Help:      "Times NATS dropped Client Commands because the Workers could not keep up",
+	}, []string{"subject"})
+
+	//Panics - Panics recovered while processing Client Commands
+	Panics = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "panics_total",
+		Help:      "Panics recovered while processing Client Commands",
+	}, []string{"op"})
+
+	//WebhookDeliveries - Attempts to deliver Events to Webhooks, by Webhook and Result
+	WebhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_deliveries_total",
+		Help:      "Attempts to deliver Events to Webhooks",
+	}, []string{"webhook", "result"})
+
+	//HookRuns - Hook Scripts run, by Hook and Result
+	HookRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hook_runs_total",
+		Help:      "Hook Scripts run before or after operations",
+	}, []string{"hook", "result"})
+
+	//Replayed - Duplicate Requests answered with the result of the first Request
+	Replayed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "replayed_total",
+		Help:      "Duplicate Requests answered with the result of the first Request",
+	}, []string{"op"})
+)
+
+func init() {
+	httpserver.Handle("/metrics", promhttp.Handler())
+}
+
+//Register adds a Collector to the /metrics endpoint
+func Register(c prometheus.Collector) {
+	prometheus.MustRegister(c)
+}
@@ -0,0 +1,34 @@
+package metrics
+
+import "sync"
+
+//UnknownRepo is the repo label for Repositories that are not known
+const UnknownRepo = "unknown"
+
+/* Repository names come from clients, so only Repositories that are configured
+ * or that a Session was opened on are used as labels. Anything else would let a
+ * client create as many series as it likes */
+var (
+	knownRepos   = make(map[string]bool)
+	knownReposMx sync.RWMutex
+)
+
+//AddRepo allows repo to be used as a repo label
+func AddRepo(repo string) {
+	if repo == "" {
+		return
+	}
+	knownReposMx.Lock()
+	defer knownReposMx.Unlock()
+	knownRepos[repo] = true
+}
+
+//RepoLabel returns the repo label for a Repository, UnknownRepo if its not known
+func RepoLabel(repo string) string {
+	knownReposMx.RLock()
+	defer knownReposMx.RUnlock()
+	if knownRepos[repo] {
+		return repo
+	}
+	return UnknownRepo
+}
@@ -0,0 +1,21 @@
+package metrics
+
+import "testing"
+
+func TestRepoLabel(t *testing.T) {
+	AddRepo("configured")
+	AddRepo("")
+	tests := []struct {
+		repo string
+		want string
+	}{
+		{"configured", "configured"},
+		{"never-seen", UnknownRepo},
+		{"", UnknownRepo},
+	}
+	for _, tt := range tests {
+		if got := RepoLabel(tt.repo); got != tt.want {
+			t.Errorf("RepoLabel(%q) = %q, want %q", tt.repo, got, tt.want)
+		}
+	}
+}
@@ -3,37 +3,67 @@
 package natsserver
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Fishwaldo/go-logadapter"
 	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 
 	"github.com/Fishwaldo/restic-nats-server/internal"
+	"github.com/Fishwaldo/restic-nats-server/internal/events"
+	"github.com/Fishwaldo/restic-nats-server/internal/health"
+	"github.com/Fishwaldo/restic-nats-server/internal/hosts"
 )
 
 var log logadapter.Logger
 
+//workerAccount is the Account Workers are placed in
+const workerAccount = "Worker"
+
 type userInfo struct {
-	Username string `mapstructure:"username"`
-	Password string `mapstructure:"password"`
+	Username    string  `mapstructure:"username"`
+	Password    string  `mapstructure:"password"`
+	NKey        string  `mapstructure:"nkey"`
+	Certificate string  `mapstructure:"certificate"`
+	Account     string  `mapstructure:"account"`
+	Role        string  `mapstructure:"role"`
+	MaxSessions int     `mapstructure:"maxsessions"`
+	OpsPerSec   float64 `mapstructure:"opspersec"`
+	OpsBurst    int     `mapstructure:"opsburst"`
+	BytesPerSec int     `mapstructure:"bytespersec"`
+	BytesBurst  int     `mapstructure:"bytesburst"`
 }
 
 type natsConfigT struct {
-	Hosts   []userInfo
-	Workers []userInfo
+	Hosts       []userInfo
+	Workers     []userInfo
+	DefaultRole string
 }
 
 var natsConfig natsConfigT
 
 var internalWorkerCred userInfo
 
+//internalWorkerKey - when users are authenticated by Certificate, the internal
+//Worker can't use a password, so it authenticates with a NKey instead
+var internalWorkerKey nkeys.KeyPair
+
+var natsServer *server.Server
+
 func init() {
 	log = internal.Log.New("natsserver")
 	viper.SetDefault("start-nats-server", true)
+	viper.SetDefault("nats.defaultrole", string(hosts.RoleAdmin))
 	internal.ConfigRegister("nats", parseConfig, validateConfig)
 }
 
@@ -49,15 +79,43 @@ func parseConfig(cfg *viper.Viper) error {
 		return errors.Wrap(err, "nats parseConfig")
 	}
 	log.Info("Host Accounts %+v\n", natsConfig.Hosts)
+	natsConfig.DefaultRole = cfg.GetString("defaultrole")
+	if natsConfig.DefaultRole == "" {
+		natsConfig.DefaultRole = string(hosts.RoleAdmin)
+	}
+	parseTLS(cfg.Sub("tls"))
+	parseServerOptions(cfg.Sub("server"))
 	return nil
 }
 
 func validateConfig() (warnings []error, err error) {
 	var warn []error
+	if err := validateTLS(); err != nil {
+		return nil, err
+	}
+	if err := validateServerOptions(); err != nil {
+		return nil, err
+	}
 	/* create a Internal Worker User */
 	internalWorkerCred.Username = internal.RandString(8)
 	internalWorkerCred.Password = internal.RandString(8)
+	if tlsConfig.Map {
+		if internalWorkerKey, err = nkeys.CreateUser(); err != nil {
+			return nil, errors.Wrap(err, "Internal Worker NKey")
+		}
+		if internalWorkerCred.NKey, err = internalWorkerKey.PublicKey(); err != nil {
+			return nil, errors.Wrap(err, "Internal Worker NKey")
+		}
+	}
 	natsConfig.Workers = append(natsConfig.Workers, internalWorkerCred)
+	for _, worker := range natsConfig.Workers {
+		if worker.NKey != "" && !nkeys.IsValidPublicUserKey(worker.NKey) {
+			return nil, errors.Errorf("Worker %s: Invalid NKey %s", worker.Username, worker.NKey)
+		}
+		if tlsConfig.Map && worker.NKey == "" && worker.Certificate == "" {
+			return nil, errors.Errorf("Worker %s needs a nkey or certificate when nats.tls.map is enabled", worker.Username)
+		}
+	}
 
 	if len(natsConfig.Hosts) == 0 {
 		warn = append(warn, errors.New("No Host Authentication Configured. Allowing Anonymous Connections"))
@@ -65,14 +123,117 @@ func validateConfig() (warnings []error, err error) {
 		natsConfig.Hosts = append(natsConfig.Hosts, tmp)
 	}
 
+	/* setup the Roles for each Host */
+	role, err := hosts.ParseRole(natsConfig.DefaultRole)
+	if err != nil {
+		return nil, errors.Wrap(err, "Default Role")
+	}
+	if err := hosts.SetDefaultRole(role); err != nil {
+		return nil, err
+	}
+	for i, host := range natsConfig.Hosts {
+		if tlsConfig.Map && host.Certificate == "" {
+			return nil, errors.Errorf("Host %s needs a certificate when nats.tls.map is enabled", host.Username)
+		}
+		if !tlsConfig.Map && host.Certificate != "" {
+			warn = append(warn, errors.Errorf("Host %s has a certificate, but nats.tls.map is disabled. Ignoring it", host.Username))
+		}
+		if host.Account == "" {
+			natsConfig.Hosts[i].Account = hosts.DefaultAccount
+		} else if err := validateAccount(host.Account); err != nil {
+			return nil, errors.Wrapf(err, "Host %s", host.Username)
+		}
+		h := hosts.Host{Account: natsConfig.Hosts[i].Account,
+			Username:    host.Username,
+			Certificate: natsUsername(host),
+			Role:        role,
+			MaxSessions: host.MaxSessions,
+			OpsPerSec:   host.OpsPerSec,
+			OpsBurst:    host.OpsBurst,
+			BytesPerSec: host.BytesPerSec,
+			BytesBurst:  host.BytesBurst,
+		}
+		if host.Role != "" {
+			if h.Role, err = hosts.ParseRole(host.Role); err != nil {
+				return nil, errors.Wrapf(err, "Host %s", host.Username)
+			}
+		}
+		if err := hosts.Register(h); err != nil {
+			return nil, err
+		}
+	}
+
 	return warn, nil
 }
 
+//validateAccount checks a Host Account name can be used in a Subject
+func validateAccount(account string) error {
+	if strings.ContainsAny(account, ".*> \t") {
+		return errors.Errorf("Invalid Account Name %s", account)
+	}
+	if account == workerAccount {
+		return errors.Errorf("Account Name %s is reserved for Workers", account)
+	}
+	return nil
+}
+
+// HostAccounts returns the Accounts Host Users are placed in
+func HostAccounts() []string {
+	var accounts []string
+	seen := make(map[string]bool)
+	for _, host := range natsConfig.Hosts {
+		if !seen[host.Account] {
+			seen[host.Account] = true
+			accounts = append(accounts, host.Account)
+		}
+	}
+	return accounts
+}
+
 func GetInternalWorkerURL() (path *url.URL, err error) {
 	if internalWorkerCred.Username == "" || internalWorkerCred.Password == "" {
 		return nil, errors.New("Internal User Credentials are empty?")
 	}
-	return url.Parse(fmt.Sprintf("nats://%s:%s@localhost:%d/", internalWorkerCred.Username, internalWorkerCred.Password, 4222))
+	scheme := "nats"
+	if TLSEnabled() {
+		scheme = "tls"
+	}
+	if internalWorkerKey != nil {
+		/* the internal Worker authenticates with InternalWorkerNKey */
+		return url.Parse(fmt.Sprintf("%s://%s/", scheme, internalAddress()))
+	}
+	return url.Parse(fmt.Sprintf("%s://%s:%s@%s/", scheme, internalWorkerCred.Username, internalWorkerCred.Password, internalAddress()))
+}
+
+// InternalWorkerNKey returns the option to authenticate the internal Worker with
+// its NKey, or nil if it authenticates with the username and password in its URL
+func InternalWorkerNKey() nats.Option {
+	if internalWorkerKey == nil {
+		return nil
+	}
+	pub, _ := internalWorkerKey.PublicKey()
+	return nats.Nkey(pub, internalWorkerKey.Sign)
+}
+
+//natsUser creates the Nats Server user for a Host or Worker
+func natsUser(user userInfo, account *server.Account) *server.User {
+	if name := natsUsername(user); name != "" {
+		return &server.User{Username: name, Account: account}
+	}
+	return &server.User{
+		Username: user.Username,
+		Password: user.Password,
+		Account:  account,
+	}
+}
+
+//natsUsername returns the name the Nats Server knows a user by. When users are
+//authenticated by Certificate, its the identity in their Certificate
+func natsUsername(user userInfo) string {
+	if tlsConfig.Map && user.Certificate != "" {
+		return user.Certificate
+	}
+	return ""
 }
 
 func Start() {
@@ -95,25 +256,29 @@ func Start() {
 	var hostaccounts []*server.Account
 	var workeraccounts []*server.Account
 	var users []*server.User
+	var nkeyusers []*server.NkeyUser
 
-	hostacc := server.NewAccount("Hosts")
-	hostaccounts = append(hostaccounts, hostacc)
-	for _, worker := range natsConfig.Hosts {
-		users = append(users, &server.User{
-			Username: worker.Username,
-			Password: worker.Password,
-			Account:  hostacc,
-		})
+	accountByName := make(map[string]*server.Account)
+	for _, name := range HostAccounts() {
+		hostacc := server.NewAccount(name)
+		hostaccounts = append(hostaccounts, hostacc)
+		accountByName[name] = hostacc
+	}
+	for _, host := range natsConfig.Hosts {
+		users = append(users, natsUser(host, accountByName[host.Account]))
 	}
 
-	workeracc := server.NewAccount("Worker")
+	workeracc := server.NewAccount(workerAccount)
 	workeraccounts = append(workeraccounts, workeracc)
 	for _, worker := range natsConfig.Workers {
-		users = append(users, &server.User{
-			Username: worker.Username,
-			Password: worker.Password,
-			Account:  workeracc,
-		})
+		if worker.NKey != "" {
+			nkeyusers = append(nkeyusers, &server.NkeyUser{
+				Nkey:    worker.NKey,
+				Account: workeracc,
+			})
+			continue
+		}
+		users = append(users, natsUser(worker, workeracc))
 	}
 
 	for _, worker := range workeraccounts {
@@ -127,6 +292,10 @@ func Start() {
 			if err := host.AddServiceImport(worker, "repo.>", stream); err != nil {
 				log.Warn("Can't Import Repo Stream %s from Worker Account %s: %s", stream, worker.Name, err)
 			}
+			/* share the client info with the worker, so it can apply the Role of the Host User */
+			if err := host.SetServiceImportSharing(worker, stream, true); err != nil {
+				log.Warn("Can't Share Client Info for Repo Stream %s with Worker Account %s: %s", stream, worker.Name, err)
+			}
 			log.Info("Exported Stream %s to %s", stream, host.Name)
 			stream = fmt.Sprintf("chunk.%s.recieve.>", host.Name)
 			if err := worker.AddServiceExportWithResponse(stream, server.Singleton, exportedhosts); err != nil {
@@ -145,6 +314,21 @@ func Start() {
 			log.Info("Exported Stream %s to %s", stream, host.Name)
 		}
 	}
+	/* Host Accounts can subscribe to the Repository Events for their own Account */
+	if prefix := events.Subject(); prefix != "" {
+		for _, worker := range workeraccounts {
+			if err := worker.AddStreamExport(prefix+".>", nil); err != nil {
+				log.Warn("Can't Export Event Stream %s from Worker Account %s: %s", prefix, worker.Name, err)
+				continue
+			}
+			for _, host := range hostaccounts {
+				stream := events.AccountSubject(host.Name)
+				if err := host.AddStreamImport(worker, stream, ""); err != nil {
+					log.Warn("Can't Import Event Stream %s to Host Account %s: %s", stream, host.Name, err)
+				}
+			}
+		}
+	}
 	// for _, host := range hostaccounts {
 	// 	stream := fmt.Sprintf("repo.%s.>", host.Name)
 	// }
@@ -152,12 +336,23 @@ func Start() {
 	opts := &server.Options{
 		Debug:      false,
 		NoSigs:     true,
-		MaxPayload: 8388608,
 		ServerName: host,
 		Cluster:    cluster,
 		Accounts:   append(hostaccounts, workeraccounts...),
 		Users:      users,
-		HTTPPort:   8081,
+		Nkeys:      nkeyusers,
+	}
+	applyServerOptions(opts)
+	log.Info("Listening for Clients on %s", net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port)))
+	if opts.HTTPPort == 0 {
+		log.Info("Monitoring Endpoint Disabled")
+	}
+	if TLSEnabled() {
+		opts.TLS = true
+		opts.TLSConfig = serverTLS
+		opts.TLSVerify = tlsConfig.Verify
+		opts.TLSMap = tlsConfig.Map
+		log.Info("Requiring TLS (Minimum Version %s, Client Certificates: %t, Authenticate by Certificate: %t)", tlsConfig.MinVersion, tlsConfig.Verify, tlsConfig.Map)
 	}
 	s, err := server.NewServer(opts)
 	s.SetLoggerV2(natslog, false, false, false)
@@ -169,10 +364,25 @@ func Start() {
 	if err := server.Run(s); err != nil {
 		log.Error("%w", err)
 	}
+	natsServer = s
+	health.RegisterReadiness("natsserver", ready)
+}
+
+//ready checks the embedded NATS server is accepting connections
+func ready(ctx context.Context) error {
+	if !natsServer.Running() || !natsServer.ReadyForConnections(50*time.Millisecond) {
+		return errors.New("Not Accepting Connections")
+	}
+	return nil
 }
 
 func Shutdown() {
+	if natsServer == nil {
+		return
+	}
 	log.Info("Shuting Down Nats Server")
+	natsServer.Shutdown()
+	natsServer.WaitForShutdown()
 }
 
 type natsLogger struct {
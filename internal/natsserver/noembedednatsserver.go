@@ -3,9 +3,15 @@
 package natsserver
 
 import (
+	"crypto/tls"
+	"net/url"
+
 	"github.com/Fishwaldo/go-logadapter"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
 
 	"github.com/Fishwaldo/restic-nats-server/internal"
+	"github.com/Fishwaldo/restic-nats-server/internal/hosts"
 )
 
 var log logadapter.Logger
@@ -15,6 +21,25 @@ func Start() {
 	log.Info("No Nats Server")
 }
 
+// HostAccounts returns the Accounts Host Users are placed in
+func HostAccounts() []string {
+	return []string{hosts.DefaultAccount}
+}
+
+func GetInternalWorkerURL() (*url.URL, error) {
+	return nil, errors.New("No Embedded Nats Server")
+}
+
+// InternalWorkerTLS returns the TLS config the internal Worker connects with, or nil if TLS is disabled
+func InternalWorkerTLS() *tls.Config {
+	return nil
+}
+
+// InternalWorkerNKey returns the option to authenticate the internal Worker with its NKey, or nil
+func InternalWorkerNKey() nats.Option {
+	return nil
+}
+
 func Shutdown() {
 	
 }
\ No newline at end of file
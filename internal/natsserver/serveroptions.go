@@ -0,0 +1,115 @@
+// +build !nonatsserver
+
+package natsserver
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultPort        = 4222
+	defaultMonitorPort = 8081
+	//defaultMonitorHost - the monitoring endpoint is unauthenticated, so only listen locally unless asked to
+	defaultMonitorHost = "127.0.0.1"
+	//minPayload - clients refuse to connect to a server with a smaller max payload
+	minPayload = 8 * 1024 * 1024
+	//maxPayload - the largest max payload the Nats Server allows
+	maxPayload = 64 * 1024 * 1024
+)
+
+type serverConfigT struct {
+	//Host and Port - where the client listener binds. Empty Host is every interface
+	Host string
+	Port int
+	//MonitorHost and MonitorPort - where the monitoring endpoint binds. Empty MonitorHost is the
+	//same as Host, and MonitorPort 0 disables it
+	MonitorHost string
+	MonitorPort int
+	MaxPayload  int32
+	//MaxConnections - 0 uses the Nats Server default
+	MaxConnections int
+	//WriteDeadline - how long a write to a client can block before its disconnected. 0 uses the Nats Server default
+	WriteDeadline time.Duration
+}
+
+var serverConfig serverConfigT
+
+func init() {
+	viper.SetDefault("nats.server.port", defaultPort)
+	viper.SetDefault("nats.server.monitoring.host", defaultMonitorHost)
+	viper.SetDefault("nats.server.monitoring.port", defaultMonitorPort)
+	viper.SetDefault("nats.server.maxpayload", minPayload)
+}
+
+//parseServerOptions parses the nats.server config section
+func parseServerOptions(cfg *viper.Viper) {
+	serverConfig = serverConfigT{Port: defaultPort, MonitorHost: defaultMonitorHost, MonitorPort: defaultMonitorPort, MaxPayload: minPayload}
+	if cfg == nil {
+		return
+	}
+	serverConfig.Host = cfg.GetString("host")
+	serverConfig.MaxConnections = cfg.GetInt("maxconnections")
+	serverConfig.WriteDeadline = cfg.GetDuration("writedeadline")
+	/* viper.Sub drops the defaults if the section exists */
+	if cfg.IsSet("port") {
+		serverConfig.Port = cfg.GetInt("port")
+	}
+	if cfg.IsSet("monitoring.host") {
+		serverConfig.MonitorHost = cfg.GetString("monitoring.host")
+	}
+	if cfg.IsSet("monitoring.port") {
+		serverConfig.MonitorPort = cfg.GetInt("monitoring.port")
+	}
+	if cfg.IsSet("maxpayload") {
+		serverConfig.MaxPayload = cfg.GetInt32("maxpayload")
+	}
+}
+
+func validateServerOptions() error {
+	if serverConfig.Port < 1 || serverConfig.Port > 65535 {
+		return errors.Errorf("nats.server.port %d is not a valid port", serverConfig.Port)
+	}
+	if serverConfig.MonitorPort < 0 || serverConfig.MonitorPort > 65535 {
+		return errors.Errorf("nats.server.monitoring.port %d is not a valid port", serverConfig.MonitorPort)
+	}
+	if serverConfig.MonitorPort == serverConfig.Port {
+		return errors.New("nats.server.port and nats.server.monitoring.port are the same")
+	}
+	if serverConfig.MaxPayload < minPayload || serverConfig.MaxPayload > maxPayload {
+		return errors.Errorf("nats.server.maxpayload must be between %d and %d", minPayload, maxPayload)
+	}
+	if serverConfig.MaxConnections < 0 {
+		return errors.New("nats.server.maxconnections can not be negative")
+	}
+	if serverConfig.WriteDeadline < 0 {
+		return errors.New("nats.server.writedeadline can not be negative")
+	}
+	return nil
+}
+
+//applyServerOptions sets the listeners and limits on the Nats Server options
+func applyServerOptions(opts *server.Options) {
+	opts.Host = serverConfig.Host
+	opts.Port = serverConfig.Port
+	opts.HTTPHost = serverConfig.MonitorHost
+	opts.HTTPPort = serverConfig.MonitorPort
+	opts.MaxPayload = serverConfig.MaxPayload
+	opts.MaxConn = serverConfig.MaxConnections
+	opts.WriteDeadline = serverConfig.WriteDeadline
+}
+
+//internalAddress is the address the internal Worker connects to. If the client
+//listener binds every interface, thats localhost
+func internalAddress() string {
+	host := serverConfig.Host
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(serverConfig.Port))
+}
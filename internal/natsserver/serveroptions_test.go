@@ -0,0 +1,71 @@
+// +build !nonatsserver
+
+package natsserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestParseServerOptions(t *testing.T) {
+	defer func(sc serverConfigT) { serverConfig = sc }(serverConfig)
+
+	parseServerOptions(nil)
+	if serverConfig.MonitorHost != defaultMonitorHost {
+		t.Errorf("no config: MonitorHost = %q, want %q", serverConfig.MonitorHost, defaultMonitorHost)
+	}
+
+	cfg := viper.New()
+	cfg.Set("host", "0.0.0.0")
+	parseServerOptions(cfg)
+	if serverConfig.MonitorHost != defaultMonitorHost {
+		t.Errorf("host set: MonitorHost = %q, want %q", serverConfig.MonitorHost, defaultMonitorHost)
+	}
+	if serverConfig.Port != defaultPort || serverConfig.MonitorPort != defaultMonitorPort || serverConfig.MaxPayload != minPayload {
+		t.Errorf("defaults not applied: %+v", serverConfig)
+	}
+
+	cfg.Set("monitoring.host", "")
+	parseServerOptions(cfg)
+	if serverConfig.MonitorHost != "" {
+		t.Errorf("monitoring.host set empty: MonitorHost = %q, want it to follow host", serverConfig.MonitorHost)
+	}
+}
+
+func TestValidateServerOptions(t *testing.T) {
+	valid := func() serverConfigT {
+		return serverConfigT{Port: defaultPort, MonitorHost: defaultMonitorHost, MonitorPort: defaultMonitorPort, MaxPayload: minPayload}
+	}
+	tests := []struct {
+		name    string
+		modify  func(sc *serverConfigT)
+		wantErr bool
+	}{
+		{"defaults", func(sc *serverConfigT) {}, false},
+		{"port 0", func(sc *serverConfigT) { sc.Port = 0 }, true},
+		{"port too large", func(sc *serverConfigT) { sc.Port = 65536 }, true},
+		{"monitoring disabled", func(sc *serverConfigT) { sc.MonitorPort = 0 }, false},
+		{"monitoring port negative", func(sc *serverConfigT) { sc.MonitorPort = -1 }, true},
+		{"monitoring port too large", func(sc *serverConfigT) { sc.MonitorPort = 65536 }, true},
+		{"same ports", func(sc *serverConfigT) { sc.MonitorPort = sc.Port }, true},
+		{"largest payload", func(sc *serverConfigT) { sc.MaxPayload = maxPayload }, false},
+		{"payload too small", func(sc *serverConfigT) { sc.MaxPayload = minPayload - 1 }, true},
+		{"payload too large", func(sc *serverConfigT) { sc.MaxPayload = maxPayload + 1 }, true},
+		{"maxconnections", func(sc *serverConfigT) { sc.MaxConnections = 100 }, false},
+		{"maxconnections negative", func(sc *serverConfigT) { sc.MaxConnections = -1 }, true},
+		{"writedeadline", func(sc *serverConfigT) { sc.WriteDeadline = 10 * time.Second }, false},
+		{"writedeadline negative", func(sc *serverConfigT) { sc.WriteDeadline = -time.Second }, true},
+	}
+	defer func(sc serverConfigT) { serverConfig = sc }(serverConfig)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConfig = valid()
+			tt.modify(&serverConfig)
+			if err := validateServerOptions(); (err != nil) != tt.wantErr {
+				t.Errorf("validateServerOptions() error = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+// +build !nonatsserver
+
+package natsserver
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+type tlsConfigT struct {
+	Cert string
+	Key  string
+	CA   string
+	//MinVersion - the lowest TLS version clients can use, 1.2 or 1.3
+	MinVersion string
+	//Verify - require clients to present a certificate signed by CA
+	Verify bool
+	//Map - authenticate users by the identity in their Client Certificate, rather than a password
+	Map bool
+	//ClientCert and ClientKey - the certificate the internal Worker presents when Verify
+	//is enabled. Defaults to Cert and Key
+	ClientCert string
+	ClientKey  string
+}
+
+var tlsConfig tlsConfigT
+
+var (
+	serverTLS *tls.Config
+	workerTLS *tls.Config
+)
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+//parseTLS parses the nats.tls config section
+func parseTLS(cfg *viper.Viper) {
+	tlsConfig = tlsConfigT{MinVersion: "1.2"}
+	if cfg == nil {
+		return
+	}
+	tlsConfig.Cert = cfg.GetString("cert")
+	tlsConfig.Key = cfg.GetString("key")
+	tlsConfig.CA = cfg.GetString("ca")
+	tlsConfig.Verify = cfg.GetBool("verify")
+	tlsConfig.Map = cfg.GetBool("map")
+	tlsConfig.ClientCert = cfg.GetString("clientcert")
+	tlsConfig.ClientKey = cfg.GetString("clientkey")
+	if v := cfg.GetString("minversion"); v != "" {
+		tlsConfig.MinVersion = v
+	}
+}
+
+//validateTLS loads the certificates, and creates the TLS config for the
+//server and the internal Worker
+func validateTLS() error {
+	serverTLS, workerTLS = nil, nil
+	if tlsConfig.Cert == "" && tlsConfig.Key == "" {
+		if tlsConfig.Verify || tlsConfig.Map || tlsConfig.CA != "" {
+			return errors.New("nats.tls: ca, verify and map need a cert and key")
+		}
+		return nil
+	}
+	version, ok := tlsVersions[tlsConfig.MinVersion]
+	if !ok {
+		return errors.Errorf("nats.tls: Unsupported minversion %s", tlsConfig.MinVersion)
+	}
+	if tlsConfig.Verify && tlsConfig.CA == "" {
+		return errors.New("nats.tls: verify needs a ca to check Client Certificates against")
+	}
+	if tlsConfig.Map && !tlsConfig.Verify {
+		return errors.New("nats.tls: map needs verify, so clients present a Certificate")
+	}
+	var err error
+	serverTLS, err = server.GenTLSConfig(&server.TLSConfigOpts{
+		CertFile: tlsConfig.Cert,
+		KeyFile:  tlsConfig.Key,
+		CaFile:   tlsConfig.CA,
+		Verify:   tlsConfig.Verify,
+	})
+	if err != nil {
+		return errors.Wrap(err, "nats.tls")
+	}
+	serverTLS.MinVersion = version
+
+	/* the internal Worker connects to localhost, which the certificate is
+	 * unlikely to be issued for. So instead of verifying the hostname, check the
+	 * server presents our own certificate */
+	servercert := serverTLS.Certificates[0].Certificate[0]
+	workerTLS = &tls.Config{
+		MinVersion:         version,
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || !bytes.Equal(rawCerts[0], servercert) {
+				return errors.New("Nats Server did not present the Configured Certificate")
+			}
+			return nil
+		},
+	}
+	if tlsConfig.Verify {
+		clientcert := serverTLS.Certificates[0]
+		if tlsConfig.ClientCert != "" || tlsConfig.ClientKey != "" {
+			if clientcert, err = tls.LoadX509KeyPair(tlsConfig.ClientCert, tlsConfig.ClientKey); err != nil {
+				return errors.Wrap(err, "nats.tls Client Certificate")
+			}
+		}
+		workerTLS.Certificates = []tls.Certificate{clientcert}
+	}
+	return nil
+}
+
+// TLSEnabled reports if the embedded Nats Server requires TLS
+func TLSEnabled() bool {
+	return serverTLS != nil
+}
+
+// InternalWorkerTLS returns the TLS config the internal Worker connects with, or nil if TLS is disabled
+func InternalWorkerTLS() *tls.Config {
+	return workerTLS
+}
@@ -0,0 +1,201 @@
+package tracing
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Fishwaldo/go-logadapter"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/Fishwaldo/restic-nats-server/internal"
+)
+
+const tracerName = "github.com/Fishwaldo/restic-nats-server"
+
+var log logadapter.Logger
+
+type tracingConfigT struct {
+	//Exporter - none, otlp, stdout or file
+	Exporter    string
+	Endpoint    string
+	Insecure    bool
+	File        string
+	SampleRate  float64
+	ServiceName string
+}
+
+var tracingConfig tracingConfigT
+
+var (
+	provider *sdktrace.TracerProvider
+	output   io.WriteCloser
+)
+
+func init() {
+	log = internal.Log.New("tracing")
+	viper.SetDefault("tracing.exporter", "none")
+	viper.SetDefault("tracing.endpoint", "localhost:4317")
+	viper.SetDefault("tracing.samplerate", 1.0)
+	viper.SetDefault("tracing.servicename", "rns")
+	internal.ConfigRegister("tracing", parseConfig, validateConfig)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+func parseConfig(cfg *viper.Viper) error {
+	tracingConfig.Exporter = strings.ToLower(cfg.GetString("exporter"))
+	tracingConfig.Endpoint = cfg.GetString("endpoint")
+	tracingConfig.Insecure = cfg.GetBool("insecure")
+	tracingConfig.File = cfg.GetString("file")
+	tracingConfig.SampleRate = cfg.GetFloat64("samplerate")
+	tracingConfig.ServiceName = cfg.GetString("servicename")
+	/* viper.Sub drops the defaults if the section exists */
+	if tracingConfig.Exporter == "" {
+		tracingConfig.Exporter = "none"
+	}
+	if tracingConfig.Endpoint == "" {
+		tracingConfig.Endpoint = "localhost:4317"
+	}
+	if !cfg.IsSet("samplerate") {
+		tracingConfig.SampleRate = 1.0
+	}
+	if tracingConfig.ServiceName == "" {
+		tracingConfig.ServiceName = "rns"
+	}
+	return nil
+}
+
+func validateConfig() (warnings []error, err error) {
+	switch tracingConfig.Exporter {
+	case "none", "otlp", "stdout":
+	case "file":
+		if tracingConfig.File == "" {
+			return nil, errors.New("tracing.file is required for the file exporter")
+		}
+	default:
+		return nil, errors.Errorf("Unknown Tracing Exporter %s", tracingConfig.Exporter)
+	}
+	if tracingConfig.SampleRate < 0 || tracingConfig.SampleRate > 1 {
+		return nil, errors.New("tracing.samplerate must be between 0 and 1")
+	}
+	return nil, nil
+}
+
+// Start the Trace Exporter. Without a exporter, spans are not recorded
+func Start() {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch tracingConfig.Exporter {
+	case "none":
+		log.Info("Tracing Disabled")
+		return
+	case "otlp":
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(tracingConfig.Endpoint)}
+		if tracingConfig.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		exporter, err = otlptracegrpc.New(context.Background(), opts...)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "file":
+		var f *os.File
+		f, err = os.OpenFile(tracingConfig.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			break
+		}
+		output = f
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	}
+	if err != nil {
+		log.Fatal("Can't Create %s Trace Exporter: %s", tracingConfig.Exporter, err)
+	}
+
+	res := resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(tracingConfig.ServiceName))
+	provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(tracingConfig.SampleRate))),
+	)
+	otel.SetTracerProvider(provider)
+	log.Info("Exporting Traces to %s", tracingConfig.Exporter)
+}
+
+// Shutdown flushes any spans that have not been exported yet
+func Shutdown() {
+	if provider == nil {
+		return
+	}
+	log.Info("Shuting Down Tracing")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := provider.Shutdown(ctx); err != nil {
+		log.Warn("Tracing Shutdown Failed: %s", err)
+	}
+	if output != nil {
+		output.Close()
+	}
+}
+
+// StartSpan starts a span as a child of any span in ctx
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// EndSpan ends a span, recording the error if there was one
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Extract returns a context with the trace context the client sent in the message headers
+func Extract(ctx context.Context, hdr nats.Header) context.Context {
+	if hdr == nil {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, headerCarrier(hdr))
+}
+
+//headerCarrier lets the propagators read NATS message headers. Unlike HTTP,
+//NATS doesn't canonicalize header keys, so we have to look up keys ourselves
+type headerCarrier nats.Header
+
+func (hc headerCarrier) Get(key string) string {
+	if v, ok := hc[key]; ok && len(v) > 0 {
+		return v[0]
+	}
+	for k, v := range hc {
+		if strings.EqualFold(k, key) && len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+func (hc headerCarrier) Set(key string, value string) {
+	hc[key] = []string{value}
+}
+
+func (hc headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(hc))
+	for k := range hc {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,261 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Fishwaldo/restic-nats-server/internal/events"
+	"github.com/Fishwaldo/restic-nats-server/internal/metrics"
+	"github.com/pkg/errors"
+)
+
+//Delivery Results, for the metrics
+const (
+	resultDelivered = "delivered"
+	resultRetry     = "retry"
+	resultFailed    = "failed"
+)
+
+//delivery is a Event waiting to be sent to a Webhook. With webhooks.queue
+//set, each one is kept in <id>.json until its delivered. Deliveries that
+//run out of retries are renamed to <id>.failed
+type delivery struct {
+	ID        string          `json:"id"`
+	Webhook   string          `json:"webhook"`
+	Event     events.Type     `json:"event"`
+	Payload   json.RawMessage `json:"payload"`
+	Attempts  int             `json:"attempts"`
+	Next      time.Time       `json:"next"`
+	LastError string          `json:"lasterror,omitempty"`
+}
+
+var (
+	queueMx sync.Mutex
+	pending = make(map[string]*delivery)
+	//wake - one per Webhook, so a slow Webhook only holds up its own deliveries
+	wake    = make(map[string]chan struct{})
+	stop    context.CancelFunc
+	running sync.WaitGroup
+)
+
+//startQueue loads the deliveries left from the last run, and starts sending them
+func startQueue() error {
+	if webhookConfig.Queue != "" {
+		if err := os.MkdirAll(webhookConfig.Queue, 0700); err != nil {
+			return err
+		}
+		files, err := filepath.Glob(filepath.Join(webhookConfig.Queue, "*.json"))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			var d delivery
+			if err := json.Unmarshal(data, &d); err != nil || d.ID == "" {
+				log.Warn("Ignoring Corrupt Webhook Delivery %s: %s", file, err)
+				continue
+			}
+			if _, ok := findHook(d.Webhook); !ok {
+				log.Warn("Dropping Delivery %s for unknown Webhook %s", d.ID, d.Webhook)
+				finish(&d)
+				continue
+			}
+			pending[d.ID] = &d
+		}
+		if len(pending) > 0 {
+			log.Info("Loaded %d Pending Webhook Deliveries", len(pending))
+		}
+	}
+	var ctx context.Context
+	ctx, stop = context.WithCancel(context.Background())
+	for _, hook := range webhookConfig.Hooks {
+		wake[hook.Name] = make(chan struct{}, 1)
+	}
+	for _, hook := range webhookConfig.Hooks {
+		running.Add(1)
+		go run(ctx, hook.Name)
+	}
+	return nil
+}
+
+//add queues a delivery, and wakes the sender for its Webhook
+func add(d *delivery) {
+	queueMx.Lock()
+	pending[d.ID] = d
+	if err := save(d); err != nil {
+		log.Warn("Can't Save Webhook Delivery %s: %s", d.ID, err)
+	}
+	queueMx.Unlock()
+	select {
+	case wake[d.Webhook] <- struct{}{}:
+	default:
+	}
+}
+
+//run sends the deliveries for a Webhook as they become due
+func run(ctx context.Context, webhook string) {
+	defer running.Done()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake[webhook]:
+		case <-timer.C:
+		}
+		for _, d := range due(webhook) {
+			if ctx.Err() != nil {
+				return
+			}
+			attempt(ctx, d)
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(untilNext(webhook))
+	}
+}
+
+//due returns the deliveries for a Webhook that should be sent now, oldest first
+func due(webhook string) []*delivery {
+	queueMx.Lock()
+	defer queueMx.Unlock()
+	now := time.Now()
+	var list []*delivery
+	for _, d := range pending {
+		if d.Webhook == webhook && !d.Next.After(now) {
+			list = append(list, d)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Next.Before(list[j].Next) })
+	return list
+}
+
+//untilNext returns how long until the next delivery for a Webhook is due
+func untilNext(webhook string) time.Duration {
+	queueMx.Lock()
+	defer queueMx.Unlock()
+	wait := time.Minute
+	for _, d := range pending {
+		if d.Webhook != webhook {
+			continue
+		}
+		if until := time.Until(d.Next); until < wait {
+			wait = until
+		}
+	}
+	if wait < 10*time.Millisecond {
+		wait = 10 * time.Millisecond
+	}
+	return wait
+}
+
+//attempt sends a delivery, and schedules a retry with exponential backoff if it fails
+func attempt(ctx context.Context, d *delivery) {
+	hook, ok := findHook(d.Webhook)
+	if !ok {
+		log.Warn("Dropping Delivery %s for unknown Webhook %s", d.ID, d.Webhook)
+		finish(d)
+		return
+	}
+	err := send(ctx, hook, d)
+	if ctx.Err() != nil {
+		/* shutting down, try again on the next start */
+		return
+	}
+	if err == nil {
+		log.Debug("Delivered %s Event to Webhook %s", d.Event, d.Webhook)
+		metrics.WebhookDeliveries.WithLabelValues(d.Webhook, resultDelivered).Inc()
+		finish(d)
+		return
+	}
+	queueMx.Lock()
+	defer queueMx.Unlock()
+	d.Attempts++
+	d.LastError = err.Error()
+	if d.Attempts > webhookConfig.MaxRetries {
+		log.Error("Giving Up on %s Event for Webhook %s after %d Attempts: %s", d.Event, d.Webhook, d.Attempts, err)
+		metrics.WebhookDeliveries.WithLabelValues(d.Webhook, resultFailed).Inc()
+		delete(pending, d.ID)
+		if err := save(d); err == nil && webhookConfig.Queue != "" {
+			file := queueFile(d.ID)
+			if err := os.Rename(file, strings.TrimSuffix(file, ".json")+".failed"); err != nil {
+				log.Warn("Can't Keep Failed Webhook Delivery %s: %s", d.ID, err)
+			}
+		}
+		return
+	}
+	backoff := webhookConfig.RetryBackoff
+	for i := 1; i < d.Attempts && backoff < webhookConfig.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > webhookConfig.MaxBackoff {
+		backoff = webhookConfig.MaxBackoff
+	}
+	d.Next = time.Now().Add(backoff)
+	log.Warn("Webhook %s Delivery %s Failed (Attempt %d), Retrying in %s: %s", d.Webhook, d.ID, d.Attempts, backoff, err)
+	metrics.WebhookDeliveries.WithLabelValues(d.Webhook, resultRetry).Inc()
+	if err := save(d); err != nil {
+		log.Warn("Can't Save Webhook Delivery %s: %s", d.ID, err)
+	}
+}
+
+//finish removes a delivery from the queue
+func finish(d *delivery) {
+	queueMx.Lock()
+	defer queueMx.Unlock()
+	delete(pending, d.ID)
+	if webhookConfig.Queue != "" {
+		if err := os.Remove(queueFile(d.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Warn("Can't Remove Webhook Delivery %s: %s", d.ID, err)
+		}
+	}
+}
+
+func queueFile(id string) string {
+	return filepath.Join(webhookConfig.Queue, id+".json")
+}
+
+//save writes a delivery to the queue directory. Must be called with queueMx held
+func save(d *delivery) error {
+	if webhookConfig.Queue == "" {
+		return nil
+	}
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	/* write and rename, so a crash never leaves a partial file */
+	tmp := queueFile(d.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, queueFile(d.ID))
+}
+
+// Shutdown stops sending deliveries. Pending deliveries stay in the queue directory
+func Shutdown() {
+	if stop == nil {
+		return
+	}
+	stop()
+	running.Wait()
+	queueMx.Lock()
+	defer queueMx.Unlock()
+	if len(pending) > 0 {
+		log.Info("%d Webhook Deliveries Pending", len(pending))
+	}
+}
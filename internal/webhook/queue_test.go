@@ -0,0 +1,43 @@
+package webhook
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Fishwaldo/restic-nats-server/internal/events"
+)
+
+func TestSlowWebhookDoesNotBlockOthers(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	delivered := make(chan struct{}, 1)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered <- struct{}{}
+	}))
+	defer fast.Close()
+
+	webhookConfig = webhookConfigT{
+		Hooks:        []hookT{{Name: "slow", URL: slow.URL}, {Name: "fast", URL: fast.URL}},
+		MaxRetries:   1,
+		RetryBackoff: time.Second,
+		MaxBackoff:   time.Second,
+	}
+	httpClient = &http.Client{Timeout: 10 * time.Second}
+	if err := startQueue(); err != nil {
+		t.Fatalf("startQueue: %s", err)
+	}
+	defer Shutdown()
+
+	enqueue(events.Event{Type: events.SnapshotSaved})
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("fast Webhook was not delivered to while the slow Webhook was blocked")
+	}
+}
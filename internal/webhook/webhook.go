@@ -0,0 +1,211 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/Fishwaldo/go-logadapter"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+
+	"github.com/Fishwaldo/restic-nats-server/internal"
+	"github.com/Fishwaldo/restic-nats-server/internal/events"
+)
+
+var log logadapter.Logger
+
+//header Keys on the requests we send
+const (
+	headerEvent     = "X-RNS-Event"
+	headerDelivery  = "X-RNS-Delivery"
+	headerSignature = "X-RNS-Signature"
+)
+
+//hookT is a single Webhook
+type hookT struct {
+	Name   string   `mapstructure:"name"`
+	URL    string   `mapstructure:"url"`
+	Secret string   `mapstructure:"secret"`
+	Events []string `mapstructure:"events"`
+}
+
+type webhookConfigT struct {
+	Hooks []hookT
+	//Queue - the directory pending deliveries are kept in, so they survive a restart
+	Queue        string
+	MaxRetries   int
+	RetryBackoff time.Duration
+	MaxBackoff   time.Duration
+	Timeout      time.Duration
+}
+
+var webhookConfig webhookConfigT
+
+var httpClient *http.Client
+
+func init() {
+	log = internal.Log.New("webhook")
+	viper.SetDefault("webhooks.maxretries", 10)
+	viper.SetDefault("webhooks.retrybackoff", "5s")
+	viper.SetDefault("webhooks.maxbackoff", "10m")
+	viper.SetDefault("webhooks.timeout", "10s")
+	internal.ConfigRegister("webhooks", parseConfig, validateConfig)
+}
+
+func parseConfig(cfg *viper.Viper) error {
+	if err := cfg.UnmarshalKey("hooks", &webhookConfig.Hooks); err != nil {
+		return errors.Wrap(err, "webhooks parseConfig")
+	}
+	webhookConfig.Queue = cfg.GetString("queue")
+	webhookConfig.MaxRetries = cfg.GetInt("maxretries")
+	webhookConfig.RetryBackoff = cfg.GetDuration("retrybackoff")
+	webhookConfig.MaxBackoff = cfg.GetDuration("maxbackoff")
+	webhookConfig.Timeout = cfg.GetDuration("timeout")
+	/* viper.Sub drops the defaults if the section exists */
+	if !cfg.IsSet("maxretries") {
+		webhookConfig.MaxRetries = 10
+	}
+	if webhookConfig.RetryBackoff == 0 {
+		webhookConfig.RetryBackoff = 5 * time.Second
+	}
+	if webhookConfig.MaxBackoff == 0 {
+		webhookConfig.MaxBackoff = 10 * time.Minute
+	}
+	if webhookConfig.Timeout == 0 {
+		webhookConfig.Timeout = 10 * time.Second
+	}
+	return nil
+}
+
+func validateConfig() (warnings []error, err error) {
+	if webhookConfig.MaxRetries < 0 {
+		return nil, errors.New("webhooks.maxretries can not be negative")
+	}
+	if webhookConfig.RetryBackoff < 0 || webhookConfig.MaxBackoff < 0 || webhookConfig.Timeout < 0 {
+		return nil, errors.New("webhooks durations can not be negative")
+	}
+	names := make(map[string]bool)
+	for i, hook := range webhookConfig.Hooks {
+		if hook.Name == "" {
+			return nil, errors.Errorf("Webhook %d has no name", i)
+		}
+		if names[hook.Name] {
+			return nil, errors.Errorf("Duplicate Webhook %s", hook.Name)
+		}
+		names[hook.Name] = true
+		u, err := url.Parse(hook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.Errorf("Webhook %s: Invalid URL %s", hook.Name, hook.URL)
+		}
+		for _, pattern := range hook.Events {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, errors.Wrapf(err, "Webhook %s: Event Filter %s", hook.Name, pattern)
+			}
+		}
+		if hook.Secret == "" {
+			warnings = append(warnings, errors.Errorf("Webhook %s has no secret. Payloads will not be signed", hook.Name))
+		}
+	}
+	if len(webhookConfig.Hooks) > 0 && webhookConfig.Queue == "" {
+		warnings = append(warnings, errors.New("No webhooks.queue Configured. Pending Webhooks will be lost on restart"))
+	}
+	return warnings, nil
+}
+
+// Start loads any deliveries left from the last run and starts delivering Events to the Webhooks
+func Start() {
+	if len(webhookConfig.Hooks) == 0 {
+		return
+	}
+	httpClient = &http.Client{Timeout: webhookConfig.Timeout}
+	if err := startQueue(); err != nil {
+		log.Fatal("Can't Start Webhook Queue: %s", err)
+	}
+	events.AddListener(enqueue)
+	for _, hook := range webhookConfig.Hooks {
+		log.Info("Delivering Events %v to Webhook %s", hook.Events, hook.Name)
+	}
+}
+
+//wants reports if the Webhook should receive the Event. No filters means every Event
+func (hook hookT) wants(typ events.Type) bool {
+	if len(hook.Events) == 0 {
+		return true
+	}
+	for _, pattern := range hook.Events {
+		if ok, _ := path.Match(pattern, string(typ)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func findHook(name string) (hookT, bool) {
+	for _, hook := range webhookConfig.Hooks {
+		if hook.Name == name {
+			return hook, true
+		}
+	}
+	return hookT{}, false
+}
+
+//enqueue queues the Event for each Webhook that wants it
+func enqueue(ev events.Event) {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		log.Warn("Can't Encode Event: %s", err)
+		return
+	}
+	for _, hook := range webhookConfig.Hooks {
+		if hook.wants(ev.Type) {
+			add(&delivery{
+				ID:      internal.RandString(16),
+				Webhook: hook.Name,
+				Event:   ev.Type,
+				Payload: payload,
+				Next:    time.Now(),
+			})
+		}
+	}
+}
+
+//sign returns the HMAC-SHA256 of the payload, as sent in the X-RNS-Signature header
+func sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+//send makes a single delivery attempt. Any 2xx response is a success
+func send(ctx context.Context, hook hookT, d *delivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(headerEvent, string(d.Event))
+	req.Header.Set(headerDelivery, d.ID)
+	if hook.Secret != "" {
+		req.Header.Set(headerSignature, sign(hook.Secret, d.Payload))
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("Webhook Returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package webhook
+
+import (
+	"testing"
+
+	"github.com/Fishwaldo/restic-nats-server/internal/events"
+)
+
+func TestSign(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  string
+		payload string
+		want    string
+	}{
+		{"empty", "", "", "sha256=b613679a0814d9ec772f95d778c35fc5ff1697c493715653c6c712144292c5ad"},
+		{"rfc example", "key", "The quick brown fox jumps over the lazy dog", "sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sign(tt.secret, []byte(tt.payload)); got != tt.want {
+				t.Errorf("sign(%q, %q) = %s, want %s", tt.secret, tt.payload, got, tt.want)
+			}
+		})
+	}
+	if sign("one", []byte("payload")) == sign("two", []byte("payload")) {
+		t.Error("sign gave the same signature for different secrets")
+	}
+}
+
+func TestWants(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []string
+		typ    events.Type
+		want   bool
+	}{
+		{"no filter", nil, events.SnapshotSaved, true},
+		{"exact", []string{"snapshot.saved"}, events.SnapshotSaved, true},
+		{"other", []string{"snapshot.saved"}, events.LockCreated, false},
+		{"wildcard", []string{"lock.*"}, events.LockStale, true},
+		{"wildcard other", []string{"lock.*"}, events.SessionOpened, false},
+		{"any of", []string{"session.*", "save.failed"}, events.SaveFailed, true},
+		{"bad pattern", []string{"["}, events.SaveFailed, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := hookT{Name: "test", Events: tt.events}
+			if got := hook.wants(tt.typ); got != tt.want {
+				t.Errorf("wants(%s) with %q = %t, want %t", tt.typ, tt.events, got, tt.want)
+			}
+		})
+	}
+}
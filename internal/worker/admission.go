@@ -0,0 +1,161 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	rns "github.com/Fishwaldo/restic-nats"
+	"github.com/Fishwaldo/restic-nats-server/internal/client"
+	"github.com/Fishwaldo/restic-nats-server/internal/hosts"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+const (
+	statusBadRequest      = 400
+	statusForbidden       = 403
+	statusNotFound        = 404
+	statusTooManyRequests = 429
+	statusInternalError   = 500
+)
+
+//warnNoUser logs once that requests arrive without a Host User
+var warnNoUser sync.Once
+
+//forward passes a Open that came in on the plain subject, for a Repository we don't
+//handle, on to the Workers that do, and the requests for a Session on to the Worker
+//that opened it. Their reply is relayed back. Reports if it was forwarded
+func (wd *Worker) forward(ri requestInfo, msg *nats.Msg) bool {
+	account := subjectAccount(msg.Subject)
+	if account == "" {
+		return false
+	}
+	var subject, notfound string
+	if ri.Op == rns.NatsOpenCmd {
+		if ri.Bucket != "" || handlesRepo(ri.Repo) || !validToken(ri.Repo) {
+			return false
+		}
+		subject = repoSubject(account, ri.Repo, ri.Op)
+		notfound = fmt.Sprintf("Repository %s is not handled by any Worker", ri.Repo)
+	} else {
+		owner := client.Owner(ri.ClientID)
+		if owner == "" || owner == client.NodeID() || !validToken(owner) {
+			return false
+		}
+		subject = sessionSubject(account, owner, ri.Op)
+		notfound = fmt.Sprintf("Session %s is not held by any Worker", ri.ClientID)
+	}
+	fwd := nats.NewMsg(subject)
+	fwd.Header = msg.Header
+	fwd.Data = msg.Data
+	deadline, _ := requestDeadline(ri, msg)
+	/* the reply subject is reserved for the service import, so we can't pass it
+	 * on. Wait for the reply in the background, so this Worker can carry on.
+	 * For a chunked request this is only the first chunk, the client sends the
+	 * rest straight to the Worker we forwarded it to */
+	go func() {
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		reply, err := wd.Conn.Conn.RequestMsgWithContext(ctx, fwd)
+		switch {
+		case err == nats.ErrNoResponders:
+			err = replyStatus(msg, &statusError{Code: statusNotFound, Message: notfound})
+		case err == nil:
+			err = msg.RespondMsg(reply)
+		}
+		if err != nil {
+			wd.Log.Warn("Forwarding %s Request %s to %s Failed: %s", ri.Op, ri.MsgID, fwd.Subject, err)
+		}
+	}()
+	wd.Log.Debug("Forwarded %s Request %s to %s", ri.Op, ri.MsgID, fwd.Subject)
+	return true
+}
+
+//admit checks if a request is permitted before it is dispatched to the backend
+func (wd *Worker) admit(ri requestInfo, msg *nats.Msg) *statusError {
+	/* without the Host User we can't tell which Role applies */
+	if ri.User == "" {
+		warnNoUser.Do(func() {
+			wd.Log.Warn("Request from Account %s has no Host User. The Nats Server must share the client info of Host Accounts with the Worker Account (share: true on the service import). Refusing all such requests", ri.Account)
+		})
+		return &statusError{Code: statusForbidden, Message: "Request has no Host User"}
+	}
+	if ri.Op == rns.NatsOpenCmd {
+		host := hosts.Find(ri.Account, ri.User)
+		if !host.Role.Allows(ri.Op, "") {
+			return &statusError{Code: statusForbidden, Message: fmt.Sprintf("Role %s may not %s", host.Role, ri.Op)}
+		}
+		var oo rns.OpenRepoOp
+		if err := wd.decodeRequest(msg, &oo); err != nil {
+			return &statusError{Code: statusBadRequest, Message: err.Error()}
+		}
+		if !validRepoName(oo.Bucket) {
+			return &statusError{Code: statusBadRequest, Message: fmt.Sprintf("Invalid Repository Name %q", oo.Bucket)}
+		}
+		if ri.Bucket != "" && ri.Bucket != oo.Bucket {
+			return &statusError{Code: statusBadRequest, Message: fmt.Sprintf("Repository %s does not match Subject %s", oo.Bucket, msg.Subject)}
+		}
+		if !handlesRepo(oo.Bucket) {
+			return &statusError{Code: statusNotFound, Message: fmt.Sprintf("Repository %s is not handled by this Worker", oo.Bucket)}
+		}
+		if err := client.CheckLimits(host.Account, host.Username, oo.Bucket); err != nil {
+			return &statusError{Code: statusTooManyRequests, Message: err.Error()}
+		}
+		return nil
+	}
+
+	session, err := client.FindSession(ri.ClientID)
+	if err != nil {
+		/* unknown sessions are dealt with when the message is processed */
+		return nil
+	}
+	if hosts.Name(session.Account, session.User) != hosts.Name(ri.Account, ri.User) {
+		return &statusError{Code: statusForbidden, Message: "Session belongs to another Host"}
+	}
+	if ri.Bucket != "" && ri.Bucket != session.Bucket {
+		return &statusError{Code: statusBadRequest, Message: fmt.Sprintf("Session is for Repository %s, not %s", session.Bucket, ri.Bucket)}
+	}
+
+	if session.ReadOnly && isWriteOp(ri.Op) {
+		return &statusError{Code: statusForbidden, Message: fmt.Sprintf("Session is Read Only. Can not %s", ri.Op)}
+	}
+
+	var file string
+	if ri.Op == rns.NatsRemoveCmd {
+		var ro rns.RemoveOp
+		if err := wd.decodeRequest(msg, &ro); err != nil {
+			return &statusError{Code: statusBadRequest, Message: err.Error()}
+		}
+		/* joined without cleaning, so Allows sees any .. */
+		file = ro.Dir + "/" + ro.Name
+	}
+	if !session.Role.Allows(ri.Op, file) {
+		return &statusError{Code: statusForbidden, Message: fmt.Sprintf("Role %s may not %s", session.Role, ri.Op)}
+	}
+	if isBulkOp(ri.Op) {
+		return wd.throttle(ri, msg, session)
+	}
+	return nil
+}
+
+//isWriteOp reports if the operation modifies the Repository
+func isWriteOp(op rns.NatsCommand) bool {
+	switch op {
+	case rns.NatsSaveCmd, rns.NatsMkdirCmd, rns.NatsRemoveCmd:
+		return true
+	}
+	return false
+}
+
+//decodeRequest decodes the operation in a message we have not dispatched yet.
+//Only small operations can be decoded here, as chunked messages are not reassembled
+func (wd *Worker) decodeRequest(msg *nats.Msg, vptr interface{}) error {
+	if msg.Header.Get(msgHeaderChunk) != "" {
+		return errors.New("Can't Decode Chunked Message")
+	}
+	if err := wd.Conn.Encoder.Decode(msg.Subject, msg.Data, vptr); err != nil {
+		return errors.Wrap(err, "Decode Failed")
+	}
+	return nil
+}
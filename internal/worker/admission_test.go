@@ -0,0 +1,171 @@
+package worker
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	rns "github.com/Fishwaldo/restic-nats"
+	"github.com/Fishwaldo/restic-nats-server/internal"
+	"github.com/Fishwaldo/restic-nats-server/internal/client"
+	"github.com/Fishwaldo/restic-nats-server/internal/hosts"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+//newTestRequest builds a request from user, as the NATS server would deliver it
+func newTestRequest(t *testing.T, user string, op rns.NatsCommand, clientid string, v interface{}) *nats.Msg {
+	t.Helper()
+	msg := nats.NewMsg("repo.Hosts.commands." + string(op))
+	msg.Header.Set(msgHeaderOperation, string(op))
+	msg.Header.Set(msgHeaderClientID, clientid)
+	nri, _ := json.Marshal(nriT{Acc: hosts.DefaultAccount, User: user})
+	msg.Header.Set(msgHeaderNRI, string(nri))
+	data, err := nats.EncoderForType("gob").Encode(msg.Subject, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Data = data
+	return msg
+}
+
+func TestAdmitBackupRole(t *testing.T) {
+	if err := hosts.Register(hosts.Host{Username: "backuphost", Role: hosts.RoleBackup}); err != nil {
+		t.Fatal(err)
+	}
+	defer func(handles []string) { internal.GlobalState.WorkerConfig.Handles = handles }(internal.GlobalState.WorkerConfig.Handles)
+	internal.GlobalState.WorkerConfig.Handles = []string{"*"}
+	wd := &Worker{Conn: &rns.ResticNatsClient{Encoder: nats.EncoderForType("gob")}}
+
+	open := newTestRequest(t, "backuphost", rns.NatsOpenCmd, "", rns.OpenRepoOp{Bucket: "backup"})
+	if serr := wd.admit(newRequestInfo(open), open); serr != nil {
+		t.Fatalf("Open refused: %s", serr)
+	}
+	session, err := client.Create(rns.OpenRepoOp{Bucket: "backup"}, client.WithAccount(hosts.DefaultAccount), client.WithUser("backuphost"), client.WithRole(hosts.RoleBackup))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Remove(session.ClientID)
+
+	/* the operations restic backup sends, in order */
+	steps := []struct {
+		op   rns.NatsCommand
+		v    interface{}
+		want bool
+	}{
+		{rns.NatsStatCmd, rns.StatOp{Filename: "config"}, true},
+		{rns.NatsLoadCmd, rns.LoadOp{Name: "config"}, true},
+		{rns.NatsListCmd, rns.ListOp{BaseDir: "keys"}, true},
+		{rns.NatsLoadCmd, rns.LoadOp{Dir: "keys", Name: "0011"}, true},
+		{rns.NatsListCmd, rns.ListOp{BaseDir: "locks"}, true},
+		{rns.NatsSaveCmd, rns.SaveOp{Dir: "locks", Name: "aabb", Filesize: 1, Data: []byte("l")}, true},
+		{rns.NatsLoadCmd, rns.LoadOp{Dir: "locks", Name: "ccdd"}, true},
+		{rns.NatsListCmd, rns.ListOp{BaseDir: "snapshots"}, true},
+		{rns.NatsLoadCmd, rns.LoadOp{Dir: "snapshots", Name: "eeff"}, true},
+		{rns.NatsListCmd, rns.ListOp{BaseDir: "index"}, true},
+		{rns.NatsLoadCmd, rns.LoadOp{Dir: "index", Name: "1122"}, true},
+		/* the trees of the parent snapshot */
+		{rns.NatsLoadCmd, rns.LoadOp{Dir: "data/33", Name: "3344", Offset: 10, Length: 100}, true},
+		{rns.NatsStatCmd, rns.StatOp{Filename: "data/55/5566"}, true},
+		{rns.NatsMkdirCmd, rns.MkdirOp{Dir: "data/55"}, true},
+		{rns.NatsSaveCmd, rns.SaveOp{Dir: "data/55", Name: "5566", Filesize: 1, Data: []byte("d")}, true},
+		{rns.NatsSaveCmd, rns.SaveOp{Dir: "index", Name: "7788", Filesize: 1, Data: []byte("i")}, true},
+		{rns.NatsSaveCmd, rns.SaveOp{Dir: "snapshots", Name: "99aa", Filesize: 1, Data: []byte("s")}, true},
+		{rns.NatsRemoveCmd, rns.RemoveOp{Dir: "locks", Name: "aabb"}, true},
+		/* but it may not prune */
+		{rns.NatsRemoveCmd, rns.RemoveOp{Dir: "data/55", Name: "5566"}, false},
+		{rns.NatsCloseCmd, rns.CloseOp{}, true},
+	}
+	for i, step := range steps {
+		msg := newTestRequest(t, "backuphost", step.op, session.ClientID, step.v)
+		serr := wd.admit(newRequestInfo(msg), msg)
+		if (serr == nil) != step.want {
+			t.Errorf("step %d %s %+v: refused %v, want allowed %t", i, step.op, step.v, serr, step.want)
+		}
+	}
+}
+
+//startTestServer runs a NATS server for the test, and connects to it
+func startTestServer(t *testing.T) *nats.Conn {
+	t.Helper()
+	srv, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, NoLog: true, NoSigs: true, MaxPayload: 8 * 1024 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Start()
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS Server didn't start")
+	}
+	t.Cleanup(srv.Shutdown)
+	nc, err := nats.Connect(srv.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+func TestForwardToOwningWorker(t *testing.T) {
+	nc := startTestServer(t)
+	defer func(handles []string) { internal.GlobalState.WorkerConfig.Handles = handles }(internal.GlobalState.WorkerConfig.Handles)
+	internal.GlobalState.WorkerConfig.Handles = []string{"repo1"}
+	defer client.RemoveAll()
+
+	/* this process is the Worker for repo1. The other Worker handles repo2,
+	 * and holds the Sessions it opened */
+	other := func(msg *nats.Msg) {
+		msg.Respond([]byte("other " + msg.Subject))
+	}
+	for _, subject := range []string{repoSubject("Hosts", "repo2", rns.NatsOpenCmd), "repo.Hosts.sessions.otherworker.*"} {
+		if _, err := nc.Subscribe(subject, other); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd := &Worker{Log: internal.Log, Conn: &rns.ResticNatsClient{Conn: nc, Encoder: nats.EncoderForType("gob")}}
+	if _, err := nc.Subscribe("repo.Hosts.commands.*", func(msg *nats.Msg) {
+		ri := newRequestInfo(msg)
+		ri.Repo = wd.requestRepo(ri, msg)
+		if !wd.forward(ri, msg) {
+			msg.Respond([]byte("local"))
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	local, err := client.Create(rns.OpenRepoOp{Bucket: "repo1"}, client.WithUser("host1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	save := rns.SaveOp{Dir: "data/00", Name: "0011", Filesize: 1, Data: []byte("d")}
+	tests := []struct {
+		name       string
+		op         rns.NatsCommand
+		clientid   string
+		v          interface{}
+		want       string
+		wantStatus string
+	}{
+		{"open our repository", rns.NatsOpenCmd, "", rns.OpenRepoOp{Bucket: "repo1"}, "local", ""},
+		{"open other repository", rns.NatsOpenCmd, "", rns.OpenRepoOp{Bucket: "repo2"}, "other repo.Hosts.commands.repo2.open", ""},
+		{"open unhandled repository", rns.NatsOpenCmd, "", rns.OpenRepoOp{Bucket: "repo3"}, "", "404"},
+		{"our session", rns.NatsSaveCmd, local.ClientID, save, "local", ""},
+		{"other session", rns.NatsSaveCmd, "otherworker-abcdefgh", save, "other repo.Hosts.sessions.otherworker.save", ""},
+		{"other session close", rns.NatsCloseCmd, "otherworker-abcdefgh", rns.CloseOp{}, "other repo.Hosts.sessions.otherworker.close", ""},
+		{"session of a stopped worker", rns.NatsSaveCmd, "goneworker-abcdefgh", save, "", "404"},
+		{"session without owner", rns.NatsSaveCmd, "abcdefgh", save, "local", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply, err := nc.RequestMsg(newTestRequest(t, "host1", tt.op, tt.clientid, tt.v), 5*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := reply.Header.Get(msgHeaderStatus); got != tt.wantStatus {
+				t.Errorf("Status = %q, want %q", got, tt.wantStatus)
+			}
+			if got := string(reply.Data); got != tt.want {
+				t.Errorf("Reply = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package worker
+
+import (
+	"context"
+	"time"
+
+	"github.com/Fishwaldo/restic-nats-server/internal/audit"
+)
+
+type auditRecordKey struct{}
+
+func newAuditRecord(ri requestInfo) *audit.Record {
+	return &audit.Record{
+		Time:    time.Now(),
+		MsgID:   ri.MsgID,
+		User:    ri.User,
+		Account: ri.Account,
+		Session: ri.ClientID,
+		Repo:    ri.Repo,
+		Op:      string(ri.Op),
+	}
+}
+
+func withAuditRecord(ctx context.Context, rec *audit.Record) context.Context {
+	return context.WithValue(ctx, auditRecordKey{}, rec)
+}
+
+//auditOp records what a operation did in the requests Audit Record.
+//path is relative to the Repository
+func auditOp(ctx context.Context, path string, bytes int64, err error) {
+	rec, ok := ctx.Value(auditRecordKey{}).(*audit.Record)
+	if !ok {
+		return
+	}
+	rec.Path = path
+	rec.Bytes = bytes
+	if err != nil {
+		rec.Error = err.Error()
+	}
+}
+
+//auditReplayed records that the request was a duplicate, and was not run again
+func auditReplayed(ctx context.Context) {
+	if rec, ok := ctx.Value(auditRecordKey{}).(*audit.Record); ok {
+		rec.Replayed = true
+	}
+}
+
+//auditSession records the Session a Open request created
+func auditSession(ctx context.Context, clientid string) {
+	if rec, ok := ctx.Value(auditRecordKey{}).(*audit.Record); ok {
+		rec.Session = clientid
+	}
+}
+
+//writeAudit completes the Audit Record once the request is finished
+func writeAudit(rec *audit.Record, result string, err error) {
+	rec.Result = result
+	if err != nil && rec.Error == "" {
+		rec.Error = err.Error()
+	}
+	audit.Write(rec)
+}
@@ -0,0 +1,115 @@
+package worker
+
+import (
+	"time"
+
+	"github.com/Fishwaldo/restic-nats-server/internal"
+	"github.com/Fishwaldo/restic-nats-server/internal/metrics"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+const (
+	statusServiceUnavailable = 503
+
+	defaultQueueSize    = 5
+	defaultPendingMsgs  = 1000
+	defaultPendingBytes = 256 * 1024 * 1024
+
+	//pendingHeadroom - the subscription's pending limits are this many times worker.pending,
+	//so messages that arrive while we reply busy are not dropped
+	pendingHeadroom = 2
+	//minRetryAfter - the shortest time we ask busy clients to wait
+	minRetryAfter = time.Second
+	//busyCheckInterval - how often we check the pending buffer while waiting for a Worker
+	busyCheckInterval = 10 * time.Millisecond
+)
+
+//parseBackpressure parses the worker.queuesize and worker.pending config
+func parseBackpressure(cfg *viper.Viper) {
+	wc := &internal.GlobalState.WorkerConfig
+	wc.QueueSize = defaultQueueSize
+	wc.PendingMsgs = defaultPendingMsgs
+	wc.PendingBytes = defaultPendingBytes
+	/* viper.Sub drops the defaults if the section exists */
+	if cfg.IsSet("queuesize") {
+		wc.QueueSize = cfg.GetInt("queuesize")
+	}
+	if cfg.IsSet("pending.msgs") {
+		wc.PendingMsgs = cfg.GetInt("pending.msgs")
+	}
+	if cfg.IsSet("pending.bytes") {
+		wc.PendingBytes = cfg.GetInt("pending.bytes")
+	}
+}
+
+func validateBackpressure() error {
+	wc := internal.GlobalState.WorkerConfig
+	if wc.QueueSize < 0 {
+		return errors.New("worker.queuesize can not be negative")
+	}
+	if wc.PendingMsgs <= 0 || wc.PendingBytes <= 0 {
+		return errors.New("worker.pending.msgs and worker.pending.bytes must be greater than 0")
+	}
+	return nil
+}
+
+//setPendingLimits sets the pending buffer of a Client Command subscription.
+//Past these limits, NATS drops messages
+func setPendingLimits(sub *nats.Subscription) error {
+	wc := internal.GlobalState.WorkerConfig
+	return sub.SetPendingLimits(wc.PendingMsgs*pendingHeadroom, wc.PendingBytes*pendingHeadroom)
+}
+
+//overloaded reports if more messages are waiting in the subscription a message
+//arrived on than worker.pending allows, and how long the client should wait before retrying
+func overloaded(msg *nats.Msg, queue chan *nats.Msg) (bool, time.Duration) {
+	if msg.Sub == nil {
+		return false, 0
+	}
+	msgs, bytes, err := msg.Sub.Pending()
+	if err != nil {
+		return false, 0
+	}
+	wc := internal.GlobalState.WorkerConfig
+	if msgs < wc.PendingMsgs && bytes < wc.PendingBytes {
+		return false, 0
+	}
+	wait := minRetryAfter
+	for _, p := range startedPools() {
+		if p.queue != queue {
+			continue
+		}
+		/* the time for the pool to work through everything already waiting */
+		if size := p.workerCount(); size > 0 {
+			if estimate := p.avgLatency() * time.Duration(msgs+len(queue)) / time.Duration(size); estimate > wait {
+				wait = estimate
+			}
+		}
+	}
+	return true, wait
+}
+
+//replyBusy tells the client we can't take the request right now
+func replyBusy(msg *nats.Msg, wait time.Duration) {
+	ri := newRequestInfo(msg)
+	ri.Repo = ri.Bucket
+	internal.Log.Debug("Server Busy. Refusing %s Request %s", ri.Op, ri.MsgID)
+	observeRequest(ri, metrics.ResultBusy, 0)
+	if err := replyStatus(msg, &statusError{Code: statusServiceUnavailable, Message: "Server Busy", RetryAfter: wait}); err != nil {
+		internal.Log.Warn("Reply Status Failed: %s", err)
+	}
+}
+
+//natsErrorHandler logs asynchronous errors from the NATS connection, and
+//counts messages dropped because we could not keep up with them
+func natsErrorHandler(nc *nats.Conn, sub *nats.Subscription, err error) {
+	if errors.Is(err, nats.ErrSlowConsumer) && sub != nil {
+		dropped, _ := sub.Dropped()
+		internal.Log.Warn("Slow Consumer on %s: %d Messages Dropped", sub.Subject, dropped)
+		metrics.SlowConsumers.WithLabelValues(sub.Subject).Inc()
+		return
+	}
+	internal.Log.Warn("Nats Error: %s", err)
+}
@@ -0,0 +1,109 @@
+package worker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/url"
+	"os"
+
+	"github.com/Fishwaldo/go-logadapter"
+	rns "github.com/Fishwaldo/restic-nats"
+	"github.com/Fishwaldo/restic-nats-server/internal"
+	"github.com/Fishwaldo/restic-nats-server/internal/natsserver"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+//validateNKey checks the NKey seed file can be used to connect
+func validateNKey(seedfile string) error {
+	seed, err := os.ReadFile(seedfile)
+	if err != nil {
+		return errors.Wrap(err, "Cannot read NKey Seed File")
+	}
+	kp, err := nkeys.ParseDecoratedNKey(seed)
+	if err != nil {
+		return errors.Wrap(err, "Invalid NKey Seed File")
+	}
+	defer kp.Wipe()
+	pub, err := kp.PublicKey()
+	if err != nil {
+		return errors.Wrap(err, "Invalid NKey Seed File")
+	}
+	if !nkeys.IsValidPublicUserKey(pub) {
+		return errors.New("NKey Seed File does not contain a User Seed")
+	}
+	return nil
+}
+
+//workerTLSConfig returns the TLS config to connect to the Nats Server with, or nil
+//if the connection is not encrypted. The internal Worker uses the embedded Nats
+//Server's config, other Workers use worker.tls
+func workerTLSConfig() (*tls.Config, error) {
+	if viper.GetBool("start-nats-server") {
+		return natsserver.InternalWorkerTLS(), nil
+	}
+	nc := internal.GlobalState.NatsConfig
+	if nc.NatsTLSCA == "" && nc.NatsTLSCert == "" && nc.NatsTLSKey == "" {
+		if nc.NatsURL != nil && nc.NatsURL.Scheme == "tls" {
+			/* verify the server against the system CAs */
+			return &tls.Config{MinVersion: tls.VersionTLS12}, nil
+		}
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if nc.NatsTLSCA != "" {
+		pem, err := os.ReadFile(nc.NatsTLSCA)
+		if err != nil {
+			return nil, errors.Wrap(err, "worker.tls.ca")
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("worker.tls.ca: No Certificates in %s", nc.NatsTLSCA)
+		}
+	}
+	if nc.NatsTLSCert != "" || nc.NatsTLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(nc.NatsTLSCert, nc.NatsTLSKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "worker.tls Client Certificate")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+//connectWithNKey connects to the NATS Server, authenticating with a NKey.
+//rns.New has no option for NKeys, so we make the connection ourselves and
+//do the same checks it does. RNSOptions can only add nats options inside rns.New,
+//so this only takes the settings it can apply itself
+func connectWithNKey(server url.URL, nkeyopt nats.Option, name string, tlsconfig *tls.Config, logger logadapter.Logger) (*rns.ResticNatsClient, error) {
+	if server.User.Username() != "" {
+		return nil, errors.New("Cannot Set a Username and Nkey at the same time")
+	}
+	natsoptions := []nats.Option{nkeyopt, nats.Name(name)}
+	if tlsconfig != nil {
+		natsoptions = append(natsoptions, nats.Secure(tlsconfig))
+	}
+	nc, err := nats.Connect(server.String(), natsoptions...)
+	if err != nil {
+		return nil, err
+	}
+	if size := nc.MaxPayload(); size < 8388608 {
+		nc.Close()
+		return nil, errors.New("NATS Server Max Payload Size is below 8Mb")
+	}
+	if !nc.HeadersSupported() {
+		nc.Close()
+		return nil, errors.New("server does not support Headers")
+	}
+	conn := &rns.ResticNatsClient{Conn: nc, Encoder: nats.EncoderForType("gob")}
+	/* these only set fields on conn, not nats options */
+	for _, opt := range []rns.RNSOptions{rns.WithLogger(logger), rns.WithServer()} {
+		if err := opt(conn); err != nil {
+			nc.Close()
+			return nil, errors.Wrap(err, "Open Failed")
+		}
+	}
+	return conn, nil
+}
@@ -0,0 +1,260 @@
+package worker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	rns "github.com/Fishwaldo/restic-nats"
+	"github.com/Fishwaldo/restic-nats-server/internal"
+	"github.com/Fishwaldo/restic-nats-server/internal/backend/localfs"
+	"github.com/Fishwaldo/restic-nats-server/internal/cache"
+	"github.com/Fishwaldo/restic-nats-server/internal/metrics"
+	"github.com/Fishwaldo/restic-nats-server/internal/tracing"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+/* A client that retries a Save or Remove gets the result of the first request,
+ * rather than running it again. The stock client sends a new X-RNS-MSGID with
+ * every request, including retries, so requests are matched by what they do:
+ * the last successful Save or Remove of each file in a Session is remembered,
+ * with a digest of the data that was saved. Only successful results are
+ * remembered, as a failed request can be safely run again. Another Session can
+ * change the file in between, so the file is checked before a result is replayed */
+
+const (
+	dedupeStoreMemory = "memory"
+	dedupeStoreCache  = "cache"
+)
+
+//defaultDedupeWindow is how long results are remembered if worker.dedupe.window is not set
+const defaultDedupeWindow = 5 * time.Minute
+
+//dedupeStore remembers the requests that completed successfully
+type dedupeStore interface {
+	//lookup returns what was remembered for key, or "" if nothing was
+	lookup(ctx context.Context, key string) (string, error)
+	remember(ctx context.Context, key, value string, window time.Duration) error
+}
+
+var (
+	dedupeResults dedupeStore
+	//inflight - requests that are being processed by this Worker, so duplicates can wait for them
+	inflight   = make(map[string]chan struct{})
+	inflightMx sync.Mutex
+)
+
+//parseDedupe parses the worker.dedupe config section
+func parseDedupe(cfg *viper.Viper) error {
+	internal.GlobalState.WorkerConfig.DedupeWindow = defaultDedupeWindow
+	internal.GlobalState.WorkerConfig.DedupeStore = dedupeStoreMemory
+	if cfg == nil {
+		return nil
+	}
+	/* viper.Sub drops the defaults if the section exists */
+	if cfg.IsSet("window") {
+		internal.GlobalState.WorkerConfig.DedupeWindow = cfg.GetDuration("window")
+	}
+	if store := cfg.GetString("store"); store != "" {
+		internal.GlobalState.WorkerConfig.DedupeStore = store
+	}
+	return nil
+}
+
+func validateDedupe() error {
+	wc := &internal.GlobalState.WorkerConfig
+	if wc.DedupeWindow < 0 {
+		return errors.New("worker.dedupe.window can not be negative")
+	}
+	switch wc.DedupeStore {
+	case dedupeStoreMemory:
+	case dedupeStoreCache:
+		if !viper.GetBool("start-cache-server") {
+			return errors.New("worker.dedupe.store is cache, but the Cache Server is not started")
+		}
+	default:
+		return errors.Errorf("Unknown worker.dedupe.store %s", wc.DedupeStore)
+	}
+	return nil
+}
+
+//startDedupe creates the store for request results, if deduplication is enabled
+func startDedupe() {
+	wc := internal.GlobalState.WorkerConfig
+	if wc.DedupeWindow == 0 {
+		internal.Log.Info("Request Deduplication Disabled")
+		return
+	}
+	switch wc.DedupeStore {
+	case dedupeStoreCache:
+		dedupeResults = cacheStore{}
+	default:
+		dedupeResults = &memoryStore{results: make(map[string]memoryResult)}
+	}
+	internal.Log.Info("Remembering Save and Remove Requests for %s in %s", wc.DedupeWindow, wc.DedupeStore)
+}
+
+//dedupeKey identifies a file in a Session. Empty if the request can't be deduplicated
+func dedupeKey(ri requestInfo, file string) string {
+	if ri.ClientID == "" {
+		return ""
+	}
+	return "rns-dedupe:" + ri.ClientID + ":" + file
+}
+
+//dedupeValue describes what a request does to a file. data is nil for a Remove
+func dedupeValue(op rns.NatsCommand, data []byte) string {
+	if data == nil {
+		return string(op)
+	}
+	sum := sha256.Sum256(data)
+	return string(op) + ":" + hex.EncodeToString(sum[:])
+}
+
+//dedupe runs op on file, unless the same request has already completed within the window
+//and done reports the file is still as it left it, in which case it reports success
+//without running it again. data is what a Save writes
+func dedupe(ctx context.Context, file string, data []byte, done func() bool, op func() (bool, error)) (bool, error) {
+	ri, _ := getRequestInfo(ctx)
+	key := dedupeKey(ri, file)
+	if dedupeResults == nil || key == "" {
+		return op()
+	}
+	value := dedupeValue(ri.Op, data)
+	/* wait for the same request if its still being processed */
+	for {
+		inflightMx.Lock()
+		wait, busy := inflight[key]
+		if !busy {
+			inflight[key] = make(chan struct{})
+			inflightMx.Unlock()
+			break
+		}
+		inflightMx.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+	defer func() {
+		inflightMx.Lock()
+		close(inflight[key])
+		delete(inflight, key)
+		inflightMx.Unlock()
+	}()
+
+	/* a Save followed by a Remove and the same Save again is not a duplicate,
+	 * as only the last request for the file is remembered */
+	last, err := dedupeResults.lookup(ctx, key)
+	if err != nil {
+		internal.Log.Warn("Can't Check for Duplicate Request %s: %s", ri.MsgID, err)
+	}
+	if last == value && !done() {
+		internal.Log.Info("Duplicate %s Request %s, but %s has changed since. Running it again", ri.Op, ri.MsgID, file)
+	} else if last == value {
+		internal.Log.Info("Replaying Result of Duplicate %s Request %s", ri.Op, ri.MsgID)
+		metrics.Replayed.WithLabelValues(string(ri.Op)).Inc()
+		auditReplayed(ctx)
+		return true, nil
+	}
+	ok, err := op()
+	if ok && err == nil {
+		if err := dedupeResults.remember(ctx, key, value, internal.GlobalState.WorkerConfig.DedupeWindow); err != nil {
+			internal.Log.Warn("Can't Remember Request %s: %s", ri.MsgID, err)
+		}
+	}
+	return ok, err
+}
+
+//fileSaved reports if a file is in the Repository with size bytes, as a Save left it
+func fileSaved(ctx context.Context, rnsclient rns.Client, dir, name string, size int) func() bool {
+	return func() bool {
+		file, err := repoFile(dir, name)
+		if err != nil {
+			return false
+		}
+		fi, err := localfs.FSStat(ctx, path.Join(rnsclient.Bucket, file))
+		return err == nil && fi.Size() == int64(size)
+	}
+}
+
+//fileRemoved reports if a file is not in the Repository, as a Remove left it
+func fileRemoved(ctx context.Context, rnsclient rns.Client, dir, name string) func() bool {
+	return func() bool {
+		file, err := repoFile(dir, name)
+		if err != nil {
+			return false
+		}
+		_, err = localfs.FSStat(ctx, path.Join(rnsclient.Bucket, file))
+		return os.IsNotExist(errors.Cause(err))
+	}
+}
+
+//memoryStore remembers results in this Worker only
+type memoryStore struct {
+	mx        sync.Mutex
+	results   map[string]memoryResult
+	lastSweep time.Time
+}
+
+type memoryResult struct {
+	value   string
+	expires time.Time
+}
+
+func (ms *memoryStore) lookup(_ context.Context, key string) (string, error) {
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
+	result, ok := ms.results[key]
+	if !ok || time.Now().After(result.expires) {
+		return "", nil
+	}
+	return result.value, nil
+}
+
+func (ms *memoryStore) remember(_ context.Context, key, value string, window time.Duration) error {
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
+	now := time.Now()
+	ms.results[key] = memoryResult{value: value, expires: now.Add(window)}
+	/* drop expired results every window, so the map doesn't keep growing */
+	if now.Sub(ms.lastSweep) > window {
+		for k, result := range ms.results {
+			if now.After(result.expires) {
+				delete(ms.results, k)
+			}
+		}
+		ms.lastSweep = now
+	}
+	return nil
+}
+
+//cacheStore remembers results in the Olric Cache, so they are shared with other Workers
+type cacheStore struct{}
+
+func (cacheStore) lookup(ctx context.Context, key string) (_ string, err error) {
+	_, span := tracing.StartSpan(ctx, "cache.Get", attribute.String("key", key))
+	defer func() { tracing.EndSpan(span, err) }()
+	value, err := cache.Get(key)
+	if errors.Is(err, cache.ErrNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	s, _ := value.(string)
+	return s, nil
+}
+
+func (cacheStore) remember(ctx context.Context, key, value string, window time.Duration) (err error) {
+	_, span := tracing.StartSpan(ctx, "cache.PutEx", attribute.String("key", key))
+	defer func() { tracing.EndSpan(span, err) }()
+	return cache.PutEx(key, value, window)
+}
@@ -0,0 +1,88 @@
+package worker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	rns "github.com/Fishwaldo/restic-nats"
+	"github.com/Fishwaldo/restic-nats-server/internal"
+)
+
+func TestDedupe(t *testing.T) {
+	savedStore, savedWindow := dedupeResults, internal.GlobalState.WorkerConfig.DedupeWindow
+	defer func() {
+		dedupeResults, internal.GlobalState.WorkerConfig.DedupeWindow = savedStore, savedWindow
+	}()
+	dedupeResults = &memoryStore{results: make(map[string]memoryResult)}
+	internal.GlobalState.WorkerConfig.DedupeWindow = time.Minute
+
+	/* the files in the Repository, as the steps leave them */
+	files := make(map[string]bool)
+	/* each step is run in order against the same store */
+	steps := []struct {
+		name    string
+		session string
+		op      rns.NatsCommand
+		file    string
+		data    []byte
+		wantRun bool
+	}{
+		{"first save", "s1", rns.NatsSaveCmd, "data/01", []byte("a"), true},
+		{"retried save", "s1", rns.NatsSaveCmd, "data/01", []byte("a"), false},
+		{"save with new data", "s1", rns.NatsSaveCmd, "data/01", []byte("b"), true},
+		{"same save in another session", "s2", rns.NatsSaveCmd, "data/01", []byte("b"), true},
+		{"save of another file", "s1", rns.NatsSaveCmd, "data/02", []byte("b"), true},
+		{"remove", "s1", rns.NatsRemoveCmd, "data/01", nil, true},
+		{"retried remove", "s1", rns.NatsRemoveCmd, "data/01", nil, false},
+		{"save after remove", "s1", rns.NatsSaveCmd, "data/01", []byte("b"), true},
+		{"remove after save", "s1", rns.NatsRemoveCmd, "data/01", nil, true},
+		{"no session", "", rns.NatsSaveCmd, "data/03", []byte("a"), true},
+		{"no session again", "", rns.NatsSaveCmd, "data/03", []byte("a"), true},
+		{"save before another session removes it", "s1", rns.NatsSaveCmd, "data/04", []byte("a"), true},
+		{"other session removes", "s2", rns.NatsRemoveCmd, "data/04", nil, true},
+		{"retried save after the file was removed", "s1", rns.NatsSaveCmd, "data/04", []byte("a"), true},
+		{"retried remove after the file was saved again", "s2", rns.NatsRemoveCmd, "data/04", nil, true},
+	}
+	for _, tt := range steps {
+		ctx := withRequestInfo(context.Background(), requestInfo{ClientID: tt.session, Op: tt.op})
+		ran := false
+		file, saving := tt.file, tt.data != nil
+		done := func() bool { return files[file] == saving }
+		ok, err := dedupe(ctx, tt.file, tt.data, done, func() (bool, error) {
+			ran = true
+			files[file] = saving
+			return true, nil
+		})
+		if !ok || err != nil {
+			t.Errorf("%s: dedupe = %t, %v, want success", tt.name, ok, err)
+		}
+		if ran != tt.wantRun {
+			t.Errorf("%s: ran = %t, want %t", tt.name, ran, tt.wantRun)
+		}
+	}
+}
+
+func TestDedupeChecksFile(t *testing.T) {
+	chdirRepos(t)
+	ctx := context.Background()
+	rnsclient := rns.Client{ClientID: "test", Bucket: "other"}
+	if !fileSaved(ctx, rnsclient, "data", "secret", len("secret"))() {
+		t.Error("fileSaved = false for a file with the saved size")
+	}
+	if fileSaved(ctx, rnsclient, "data", "secret", 1)() {
+		t.Error("fileSaved = true for a file with another size")
+	}
+	if fileSaved(ctx, rnsclient, "data", "gone", 0)() {
+		t.Error("fileSaved = true for a missing file")
+	}
+	if fileRemoved(ctx, rnsclient, "data", "secret")() {
+		t.Error("fileRemoved = true for a file that exists")
+	}
+	if !fileRemoved(ctx, rnsclient, "data", "gone")() {
+		t.Error("fileRemoved = false for a missing file")
+	}
+	if fileRemoved(ctx, rns.Client{Bucket: "backup"}, "../other/data", "gone")() {
+		t.Error("fileRemoved = true for a path outside the Repository")
+	}
+}
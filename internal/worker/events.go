@@ -0,0 +1,133 @@
+package worker
+
+import (
+	"context"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	rns "github.com/Fishwaldo/restic-nats"
+	"github.com/Fishwaldo/restic-nats-server/internal"
+	"github.com/Fishwaldo/restic-nats-server/internal/backend/localfs"
+	"github.com/Fishwaldo/restic-nats-server/internal/client"
+	"github.com/Fishwaldo/restic-nats-server/internal/events"
+	"github.com/Fishwaldo/restic-nats-server/internal/hosts"
+)
+
+//sessionEvent publishes a Event about a Session
+func sessionEvent(typ events.Type, session client.Session, file string, bytes int64) {
+	events.Publish(sessionEventFor(typ, session, file, bytes))
+}
+
+func sessionEventFor(typ events.Type, session client.Session, file string, bytes int64) events.Event {
+	return events.Event{
+		Type:     typ,
+		Account:  session.Account,
+		User:     session.User,
+		Hostname: session.Hostname,
+		Session:  session.ClientID,
+		Repo:     session.Bucket,
+		Path:     file,
+		Bytes:    bytes,
+	}
+}
+
+//expireSessions periodically closes Sessions that have been idle for sessions.idletimeout
+func expireSessions() error {
+	/* check often enough that a Session doesn't outlive the timeout by much */
+	ticker := time.NewTicker(client.IdleTimeout() / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-internal.GlobalState.T.Dying():
+			return nil
+		case now := <-ticker.C:
+			for _, session := range client.ExpireIdle(now) {
+				internal.Log.Info("Session %s for %s on %s Expired after %s Idle", session.ClientID, hosts.Name(session.Account, session.User), session.Bucket, client.IdleTimeout())
+				ev := sessionEventFor(events.SessionClosed, session, "", 0)
+				ev.Error = "Session Expired"
+				events.Publish(ev)
+				if !session.ReadOnly {
+					measureRepo(session)
+				}
+			}
+		}
+	}
+}
+
+//fileEvent publishes the Event for a file that was saved or removed, if there is one.
+//restic keeps each type of file in its own directory, so that tells us what the file is
+func fileEvent(ctx context.Context, rnsclient rns.Client, dir, name string, bytes int64, saved bool) {
+	var typ events.Type
+	switch kind := strings.SplitN(path.Clean(dir), "/", 2)[0]; {
+	case saved && kind == "snapshots":
+		typ = events.SnapshotSaved
+	case saved && kind == "locks":
+		typ = events.LockCreated
+	case !saved && kind == "locks":
+		typ = events.LockRemoved
+	case !saved:
+		typ = events.FileDeleted
+	default:
+		return
+	}
+	if typ == events.LockRemoved {
+		forgetStaleLock(rnsclient.Bucket, path.Join(dir, name))
+	}
+	sessionEvent(typ, requestSession(ctx, rnsclient), path.Join(dir, name), bytes)
+}
+
+//saveFailedEvent publishes the Event for a Save that failed
+func saveFailedEvent(ctx context.Context, rnsclient rns.Client, dir, name string, err error) {
+	ev := sessionEventFor(events.SaveFailed, requestSession(ctx, rnsclient), path.Join(dir, name), 0)
+	ev.Error = err.Error()
+	events.Publish(ev)
+}
+
+//requestSession returns the Session a request was sent on
+func requestSession(ctx context.Context, rnsclient rns.Client) client.Session {
+	session, err := client.FindSession(rnsclient.ClientID)
+	if err != nil {
+		/* we still know who sent the request */
+		ri, _ := getRequestInfo(ctx)
+		session = client.Session{Client: rnsclient, Account: ri.Account, User: ri.User}
+	}
+	return session
+}
+
+var (
+	//staleLocks - the locks we have reported as stale, and their modification time when we did
+	staleLocks   = make(map[string]time.Time)
+	staleLocksMx sync.Mutex
+)
+
+//checkStaleLocks publishes a Event for each lock that has not been refreshed
+//within events.stalelockage. Each lock is only reported once
+func checkStaleLocks(ctx context.Context, rnsclient rns.Client, dir string, files []rns.FileInfo) {
+	maxAge := events.StaleLockAge()
+	if maxAge == 0 || path.Clean(dir) != "locks" {
+		return
+	}
+	for _, file := range files {
+		lock := path.Join("locks", file.Name)
+		fi, err := localfs.FSStat(ctx, path.Join(rnsclient.Bucket, lock))
+		if err != nil || time.Since(fi.ModTime()) < maxAge {
+			continue
+		}
+		key := rnsclient.Bucket + "/" + lock
+		staleLocksMx.Lock()
+		reported := staleLocks[key].Equal(fi.ModTime())
+		staleLocks[key] = fi.ModTime()
+		staleLocksMx.Unlock()
+		if !reported {
+			sessionEvent(events.LockStale, requestSession(ctx, rnsclient), lock, fi.Size())
+		}
+	}
+}
+
+func forgetStaleLock(repo, lock string) {
+	staleLocksMx.Lock()
+	defer staleLocksMx.Unlock()
+	delete(staleLocks, repo+"/"+lock)
+}
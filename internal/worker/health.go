@@ -0,0 +1,59 @@
+package worker
+
+import (
+	"context"
+	"time"
+
+	"github.com/Fishwaldo/restic-nats-server/internal"
+	"github.com/Fishwaldo/restic-nats-server/internal/backend/localfs"
+	"github.com/Fishwaldo/restic-nats-server/internal/health"
+	"github.com/pkg/errors"
+)
+
+//stuckGrace is how long past its timeout a operation can run before we consider
+//the Worker stuck. Operations should return soon after their context is canceled
+const stuckGrace = time.Minute
+
+func registerHealthChecks() {
+	health.RegisterReadiness("worker.connection", connectionReady)
+	health.RegisterReadiness("worker.subscriptions", subscriptionsReady)
+	health.RegisterReadiness("backend.localfs", localfs.FSProbe)
+	health.RegisterLiveness("worker.pools", poolsLive)
+}
+
+func connectionReady(ctx context.Context) error {
+	internal.GlobalState.Mx.Lock()
+	conn := internal.GlobalState.Conn
+	internal.GlobalState.Mx.Unlock()
+	if conn == nil {
+		return errors.New("Not Connected")
+	}
+	if !conn.Conn.IsConnected() {
+		return errors.Errorf("Connection is %s", conn.Conn.Status())
+	}
+	return nil
+}
+
+func subscriptionsReady(ctx context.Context) error {
+	subs := commandSubscriptions()
+	if len(subs) == 0 {
+		return errors.New("Not Subscribed")
+	}
+	for _, sub := range subs {
+		if !sub.IsValid() {
+			return errors.Errorf("Subscription %s is closed", sub.Subject)
+		}
+	}
+	return nil
+}
+
+//poolsLive checks no Worker is stuck on a operation that should have timed out
+func poolsLive(ctx context.Context) error {
+	limit := maxTimeout() + stuckGrace
+	for _, p := range startedPools() {
+		if stuck := p.stuck(limit); stuck > 0 {
+			return errors.Errorf("%d Workers in Pool %s busy for more than %s", stuck, p.name, limit)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package worker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/Fishwaldo/restic-nats-server/internal"
+	"github.com/Fishwaldo/restic-nats-server/internal/httpserver"
+)
+
+//checkStatus fetches a health endpoint, and returns the result of each check
+func checkStatus(t *testing.T, path string) map[string]string {
+	rec := httptest.NewRecorder()
+	httpserver.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	var status struct {
+		Checks map[string]string `json:"checks"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Errorf("%s returned %s", path, err)
+	}
+	return status.Checks
+}
+
+/* run with -race: the health checks must not race the Worker starting up */
+func TestReadyWhileStarting(t *testing.T) {
+	nc := startTestServer(t)
+	natsurl, err := url.Parse(nc.ConnectedUrl())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(wc internal.WorkerConfigT, nc internal.NatsConfigT) {
+		internal.GlobalState.WorkerConfig = wc
+		internal.GlobalState.NatsConfig = nc
+	}(internal.GlobalState.WorkerConfig, internal.GlobalState.NatsConfig)
+	internal.GlobalState.NatsConfig = internal.NatsConfigT{NatsURL: natsurl}
+	internal.GlobalState.WorkerConfig.Accounts = []string{"Hosts"}
+	internal.GlobalState.WorkerConfig.Handles = []string{"*"}
+	internal.GlobalState.WorkerConfig.NumWorkers = 1
+	internal.GlobalState.WorkerConfig.MinWorkers = 1
+	internal.GlobalState.WorkerConfig.MaxWorkers = 1
+	internal.GlobalState.WorkerConfig.Bulk = nil
+	internal.GlobalState.WorkerConfig.QueueSize = 1
+	internal.GlobalState.WorkerConfig.PendingMsgs = 10
+	internal.GlobalState.WorkerConfig.PendingBytes = 1024 * 1024
+
+	started := make(chan struct{})
+	go func() {
+		defer close(started)
+		startWorker()
+	}()
+	defer func() {
+		for _, sub := range commandSubscriptions() {
+			sub.Unsubscribe()
+		}
+		setCommandSubscriptions(nil)
+		setPools(nil)
+		internal.GlobalState.Mx.Lock()
+		internal.GlobalState.Conn.Conn.Close()
+		internal.GlobalState.Conn = nil
+		internal.GlobalState.Mx.Unlock()
+	}()
+	for running := true; running; {
+		select {
+		case <-started:
+			running = false
+		default:
+		}
+		checkStatus(t, "/readyz")
+		checkStatus(t, "/healthz")
+	}
+	checks := checkStatus(t, "/readyz")
+	for _, name := range []string{"worker.connection", "worker.subscriptions"} {
+		if checks[name] != "ok" {
+			t.Errorf("%s = %q once started, want ok", name, checks[name])
+		}
+	}
+	if checks := checkStatus(t, "/healthz"); checks["worker.pools"] != "ok" {
+		t.Errorf("worker.pools = %q once started, want ok", checks["worker.pools"])
+	}
+}
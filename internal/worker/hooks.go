@@ -0,0 +1,324 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	rns "github.com/Fishwaldo/restic-nats"
+	"github.com/Fishwaldo/restic-nats-server/internal"
+	"github.com/Fishwaldo/restic-nats-server/internal/client"
+	"github.com/Fishwaldo/restic-nats-server/internal/metrics"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+/* Hook Scripts are external commands run before or after a operation. A pre
+ * hook that exits non-zero rejects the operation. Post hooks are queued once a
+ * operation succeeds, so they don't delay the reply, and run by a fixed number
+ * of hook workers. If the queue is full the post hook is dropped */
+
+const (
+	hookPre  = "pre"
+	hookPost = "post"
+)
+
+//defaultHookTimeout is how long a Hook Script can run if it has no timeout
+const defaultHookTimeout = 30 * time.Second
+
+//defaultHookWorkers and defaultHookQueue limit how many post hooks run at once, and how many can wait
+const (
+	defaultHookWorkers = 4
+	defaultHookQueue   = 100
+)
+
+//hookScriptT is a single Hook Script from worker.hooks
+type hookScriptT struct {
+	Name string `mapstructure:"name"`
+	//When - pre or post
+	When string `mapstructure:"when"`
+	//Ops - the operations the Hook runs for
+	Ops []string `mapstructure:"ops"`
+	//Repos and Paths - patterns the Repository and the file must match. Empty matches everything
+	Repos   []string      `mapstructure:"repos"`
+	Paths   []string      `mapstructure:"paths"`
+	Command []string      `mapstructure:"command"`
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+//hookContext is passed to Hook Scripts as JSON on stdin, and in RNS_ environment variables
+type hookContext struct {
+	Hook     string `json:"hook"`
+	When     string `json:"when"`
+	Op       string `json:"op"`
+	Account  string `json:"account,omitempty"`
+	User     string `json:"user,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	Session  string `json:"session,omitempty"`
+	Repo     string `json:"repo"`
+	Path     string `json:"path,omitempty"`
+	Bytes    int64  `json:"bytes,omitempty"`
+	MsgID    string `json:"msgid,omitempty"`
+}
+
+//hookJob is a post hook waiting for a hook worker
+type hookJob struct {
+	hook hookScriptT
+	hc   hookContext
+}
+
+var (
+	hookScripts []hookScriptT
+	hookWorkers int
+	//hookQueue - post hooks waiting for a hook worker. nil until startHooks
+	hookQueue     chan hookJob
+	hookQueueSize int
+	//hooksRunning - post hooks that are queued or running
+	hooksRunning sync.WaitGroup
+)
+
+//parseHooks parses the worker.hooks config section
+func parseHooks(cfg *viper.Viper) error {
+	hookScripts = nil
+	/* viper.Sub drops the defaults if the section exists */
+	hookWorkers = defaultHookWorkers
+	if cfg.IsSet("hookworkers") {
+		hookWorkers = cfg.GetInt("hookworkers")
+	}
+	hookQueueSize = defaultHookQueue
+	if cfg.IsSet("hookqueue") {
+		hookQueueSize = cfg.GetInt("hookqueue")
+	}
+	if err := cfg.UnmarshalKey("hooks", &hookScripts); err != nil {
+		return errors.Wrap(err, "worker.hooks")
+	}
+	for i := range hookScripts {
+		hookScripts[i].When = strings.ToLower(hookScripts[i].When)
+		for j := range hookScripts[i].Ops {
+			hookScripts[i].Ops[j] = strings.ToLower(hookScripts[i].Ops[j])
+		}
+		if hookScripts[i].Timeout == 0 {
+			hookScripts[i].Timeout = defaultHookTimeout
+		}
+	}
+	return nil
+}
+
+func validateHooks() error {
+	if hookWorkers <= 0 {
+		return errors.New("worker.hookworkers must be greater than 0")
+	}
+	if hookQueueSize < 0 {
+		return errors.New("worker.hookqueue can not be negative")
+	}
+	for i, hook := range hookScripts {
+		if hook.Name == "" {
+			return errors.Errorf("worker.hooks: Hook %d has no name", i)
+		}
+		if hook.When != hookPre && hook.When != hookPost {
+			return errors.Errorf("Hook %s: when must be pre or post", hook.Name)
+		}
+		if len(hook.Ops) == 0 {
+			return errors.Errorf("Hook %s has no ops", hook.Name)
+		}
+		for _, op := range hook.Ops {
+			if !isKnownOp(rns.NatsCommand(op)) {
+				return errors.Errorf("Hook %s: Unknown Operation %s", hook.Name, op)
+			}
+			/* Close always succeeds, so it can't be rejected */
+			if hook.When == hookPre && op == string(rns.NatsCloseCmd) {
+				return errors.Errorf("Hook %s: close only supports post hooks", hook.Name)
+			}
+		}
+		for _, pattern := range append(append([]string{}, hook.Repos...), hook.Paths...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Wrapf(err, "Hook %s: Pattern %s", hook.Name, pattern)
+			}
+		}
+		if len(hook.Command) == 0 {
+			return errors.Errorf("Hook %s has no command", hook.Name)
+		}
+		if _, err := exec.LookPath(hook.Command[0]); err != nil {
+			return errors.Wrapf(err, "Hook %s", hook.Name)
+		}
+		if hook.Timeout < 0 {
+			return errors.Errorf("Hook %s: timeout can not be negative", hook.Name)
+		}
+	}
+	return nil
+}
+
+//matchAny reports if name matches one of the patterns. No patterns matches everything
+func matchAny(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (hook hookScriptT) wants(when string, op rns.NatsCommand, repo, file string) bool {
+	if hook.When != when || !hasOp(hook.Ops, op) {
+		return false
+	}
+	return matchAny(hook.Repos, repo) && matchAny(hook.Paths, file)
+}
+
+func hasOp(ops []string, op rns.NatsCommand) bool {
+	for _, o := range ops {
+		if o == string(op) {
+			return true
+		}
+	}
+	return false
+}
+
+//newHookContext describes the request for the Hook Scripts. file is the path from repoPath,
+//so Hooks match the Repository and file the backend acts on, not what the client sent
+func newHookContext(ctx context.Context, session client.Session, file string, bytes int64) hookContext {
+	ri, _ := getRequestInfo(ctx)
+	return hookContext{
+		Op:       string(ri.Op),
+		Account:  session.Account,
+		User:     session.User,
+		Hostname: session.Hostname,
+		Session:  session.ClientID,
+		Repo:     session.Bucket,
+		Path:     file,
+		Bytes:    bytes,
+		MsgID:    ri.MsgID,
+	}
+}
+
+//preHooks runs the pre Hook Scripts for the request, returning a error if one rejects it
+func preHooks(ctx context.Context, session client.Session, file string, bytes int64) error {
+	hc := newHookContext(ctx, session, file, bytes)
+	for _, hook := range hookScripts {
+		if !hook.wants(hookPre, rns.NatsCommand(hc.Op), hc.Repo, hc.Path) {
+			continue
+		}
+		if err := runHook(ctx, hook, hc); err != nil {
+			return errors.Wrapf(err, "Rejected by Hook %s", hook.Name)
+		}
+	}
+	return nil
+}
+
+//startHooks starts the hook workers, if there are any post hooks
+func startHooks() {
+	for _, hook := range hookScripts {
+		if hook.When == hookPost {
+			hookQueue = make(chan hookJob, hookQueueSize)
+			for i := 0; i < hookWorkers; i++ {
+				go runPostHooks(hookQueue)
+			}
+			internal.Log.Info("Started %d Hook Workers (Queue %d)", hookWorkers, hookQueueSize)
+			return
+		}
+	}
+}
+
+//runPostHooks is a hook worker, running the queued post hooks
+func runPostHooks(queue chan hookJob) {
+	for job := range queue {
+		/* the request is finished, so don't use its context */
+		if err := runHook(context.Background(), job.hook, job.hc); err != nil {
+			internal.Log.Warn("Hook %s Failed: %s", job.hook.Name, err)
+		}
+		hooksRunning.Done()
+	}
+}
+
+//postHooks queues the post Hook Scripts for a request that succeeded
+func postHooks(ctx context.Context, session client.Session, file string, bytes int64) {
+	hc := newHookContext(ctx, session, file, bytes)
+	for _, hook := range hookScripts {
+		if !hook.wants(hookPost, rns.NatsCommand(hc.Op), hc.Repo, hc.Path) {
+			continue
+		}
+		queueHook(hook, hc)
+	}
+}
+
+//queueHook queues a post hook for the hook workers, dropping it if the queue is full
+func queueHook(hook hookScriptT, hc hookContext) {
+	hooksRunning.Add(1)
+	select {
+	case hookQueue <- hookJob{hook: hook, hc: hc}:
+	default:
+		hooksRunning.Done()
+		metrics.HookRuns.WithLabelValues(hook.Name, metrics.ResultBusy).Inc()
+		internal.Log.Warn("Hook Queue Full. Dropped Hook %s for %s %s/%s", hook.Name, hc.Op, hc.Repo, hc.Path)
+	}
+}
+
+//runHook runs a Hook Script, with the request as JSON on stdin and in the environment
+func runHook(ctx context.Context, hook hookScriptT, hc hookContext) error {
+	hc.Hook = hook.Name
+	hc.When = hook.When
+	input, err := json.Marshal(hc)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, hook.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Env = append(os.Environ(),
+		"RNS_HOOK="+hc.Hook,
+		"RNS_WHEN="+hc.When,
+		"RNS_OP="+hc.Op,
+		"RNS_ACCOUNT="+hc.Account,
+		"RNS_USER="+hc.User,
+		"RNS_HOSTNAME="+hc.Hostname,
+		"RNS_SESSION="+hc.Session,
+		"RNS_REPO="+hc.Repo,
+		"RNS_PATH="+hc.Path,
+		fmt.Sprintf("RNS_BYTES=%d", hc.Bytes),
+		"RNS_MSGID="+hc.MsgID,
+	)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	start := time.Now()
+	err = cmd.Run()
+	internal.Log.Debug("Hook %s for %s %s/%s took %s: %s", hook.Name, hc.Op, hc.Repo, hc.Path, time.Since(start), strings.TrimSpace(output.String()))
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		metrics.HookRuns.WithLabelValues(hook.Name, metrics.ResultExpired).Inc()
+		return errors.Errorf("Timed Out after %s", hook.Timeout)
+	case err != nil:
+		metrics.HookRuns.WithLabelValues(hook.Name, metrics.ResultFailed).Inc()
+		if msg := strings.TrimSpace(output.String()); msg != "" {
+			return errors.Errorf("%s: %s", err, msg)
+		}
+		return err
+	}
+	metrics.HookRuns.WithLabelValues(hook.Name, metrics.ResultOk).Inc()
+	return nil
+}
+
+//waitHooks waits for queued and running post hooks to finish, up to timeout
+func waitHooks(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		hooksRunning.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		internal.Log.Warn("Post Hooks still Running after %s", timeout)
+	}
+}
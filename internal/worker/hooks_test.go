@@ -0,0 +1,142 @@
+package worker
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	rns "github.com/Fishwaldo/restic-nats"
+)
+
+func TestHookWants(t *testing.T) {
+	hook := hookScriptT{
+		Name:  "test",
+		When:  hookPost,
+		Ops:   []string{"save", "remove"},
+		Repos: []string{"archive-*"},
+		Paths: []string{"snapshots/*"},
+	}
+	tests := []struct {
+		name string
+		when string
+		op   rns.NatsCommand
+		repo string
+		file string
+		want bool
+	}{
+		{"match", hookPost, rns.NatsSaveCmd, "archive-1", "snapshots/abc", true},
+		{"other op", hookPost, rns.NatsRemoveCmd, "archive-1", "snapshots/abc", true},
+		{"wrong when", hookPre, rns.NatsSaveCmd, "archive-1", "snapshots/abc", false},
+		{"wrong op", hookPost, rns.NatsLoadCmd, "archive-1", "snapshots/abc", false},
+		{"wrong repo", hookPost, rns.NatsSaveCmd, "backup", "snapshots/abc", false},
+		{"wrong path", hookPost, rns.NatsSaveCmd, "archive-1", "data/ab/abc", false},
+		{"nested path", hookPost, rns.NatsSaveCmd, "archive-1", "snapshots/a/b", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hook.wants(tt.when, tt.op, tt.repo, tt.file); got != tt.want {
+				t.Errorf("wants(%s, %s, %s, %s) = %t, want %t", tt.when, tt.op, tt.repo, tt.file, got, tt.want)
+			}
+		})
+	}
+	all := hookScriptT{Name: "any", When: hookPre, Ops: []string{"open"}}
+	if !all.wants(hookPre, rns.NatsOpenCmd, "backup", "") {
+		t.Error("Hook without Repos or Paths should match every Repository")
+	}
+}
+
+func TestValidateHooks(t *testing.T) {
+	valid := func() hookScriptT {
+		return hookScriptT{Name: "test", When: hookPost, Ops: []string{"save"}, Command: []string{"sh", "-c", "true"}, Timeout: time.Second}
+	}
+	tests := []struct {
+		name    string
+		modify  func(h *hookScriptT)
+		workers int
+		queue   int
+		wantErr bool
+	}{
+		{"valid", func(h *hookScriptT) {}, 1, 0, false},
+		{"no name", func(h *hookScriptT) { h.Name = "" }, 1, 0, true},
+		{"bad when", func(h *hookScriptT) { h.When = "during" }, 1, 0, true},
+		{"no ops", func(h *hookScriptT) { h.Ops = nil }, 1, 0, true},
+		{"unknown op", func(h *hookScriptT) { h.Ops = []string{"rename"} }, 1, 0, true},
+		{"pre close", func(h *hookScriptT) { h.When = hookPre; h.Ops = []string{"close"} }, 1, 0, true},
+		{"post close", func(h *hookScriptT) { h.Ops = []string{"close"} }, 1, 0, false},
+		{"bad repo pattern", func(h *hookScriptT) { h.Repos = []string{"["} }, 1, 0, true},
+		{"bad path pattern", func(h *hookScriptT) { h.Paths = []string{"["} }, 1, 0, true},
+		{"no command", func(h *hookScriptT) { h.Command = nil }, 1, 0, true},
+		{"missing command", func(h *hookScriptT) { h.Command = []string{"/nonexistent/rns-hook"} }, 1, 0, true},
+		{"negative timeout", func(h *hookScriptT) { h.Timeout = -time.Second }, 1, 0, true},
+		{"no workers", func(h *hookScriptT) {}, 0, 0, true},
+		{"negative queue", func(h *hookScriptT) {}, 1, -1, true},
+	}
+	defer func(scripts []hookScriptT, workers, queue int) {
+		hookScripts, hookWorkers, hookQueueSize = scripts, workers, queue
+	}(hookScripts, hookWorkers, hookQueueSize)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := valid()
+			tt.modify(&hook)
+			hookScripts = []hookScriptT{hook}
+			hookWorkers, hookQueueSize = tt.workers, tt.queue
+			if err := validateHooks(); (err != nil) != tt.wantErr {
+				t.Errorf("validateHooks() error = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestQueueHookDropsWhenFull(t *testing.T) {
+	defer func(queue chan hookJob) { hookQueue = queue }(hookQueue)
+	hookQueue = make(chan hookJob, 1)
+	hook := hookScriptT{Name: "test", When: hookPost}
+	queueHook(hook, hookContext{})
+	queueHook(hook, hookContext{})
+	if len(hookQueue) != 1 {
+		t.Fatalf("queue has %d jobs, want 1", len(hookQueue))
+	}
+	<-hookQueue
+	hooksRunning.Done()
+	done := make(chan struct{})
+	go func() {
+		hooksRunning.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("dropped Hook is still counted as running")
+	}
+}
+
+func TestPreHooksMatchResolvedPath(t *testing.T) {
+	chdirRepos(t)
+	defer func(scripts []hookScriptT) { hookScripts = scripts }(hookScripts)
+	hookScripts = []hookScriptT{
+		{Name: "nostat", When: hookPre, Ops: []string{"stat"}, Paths: []string{"snapshots/*"}, Command: []string{"false"}, Timeout: time.Second},
+		{Name: "nodelete", When: hookPre, Ops: []string{"remove"}, Repos: []string{"other"}, Command: []string{"false"}, Timeout: time.Second},
+	}
+	wd := &Worker{}
+	stat := withRequestInfo(context.Background(), requestInfo{Op: rns.NatsStatCmd})
+	remove := withRequestInfo(context.Background(), requestInfo{Op: rns.NatsRemoveCmd})
+	backup := rns.Client{ClientID: "test", Bucket: "backup"}
+
+	/* the path is cleaned before the Hook sees it, so it still matches snapshots/* */
+	if r, err := wd.Stat(stat, backup, rns.StatOp{Filename: "./snapshots//abc"}); r.Ok || err == nil || !strings.Contains(err.Error(), "nostat") {
+		t.Errorf("Stat of ./snapshots//abc: Ok %t, error %v, want it rejected by nostat", r.Ok, err)
+	}
+	/* a Remove in another Repository can't get around its veto */
+	if r, err := wd.Remove(remove, backup, rns.RemoveOp{Dir: "../other/data", Name: "secret"}); r.Ok || err == nil {
+		t.Errorf("Remove of ../other/data/secret: Ok %t, error %v, want it refused", r.Ok, err)
+	}
+	if _, err := os.Stat("repo/other/data/secret"); err != nil {
+		t.Errorf("file in other Repository was removed: %v", err)
+	}
+	other := rns.Client{ClientID: "test", Bucket: "other"}
+	if r, err := wd.Remove(remove, other, rns.RemoveOp{Dir: "data", Name: "secret"}); r.Ok || err == nil || !strings.Contains(err.Error(), "nodelete") {
+		t.Errorf("Remove in other: Ok %t, error %v, want it rejected by nodelete", r.Ok, err)
+	}
+}
@@ -0,0 +1,33 @@
+package worker
+
+import (
+	"io/fs"
+	"time"
+
+	rns "github.com/Fishwaldo/restic-nats"
+	"github.com/Fishwaldo/restic-nats-server/internal/metrics"
+	"github.com/pkg/errors"
+)
+
+//observeRequest records a Client Command in the Prometheus metrics. took
+//is only recorded for requests that were dispatched
+func observeRequest(ri requestInfo, result string, took time.Duration) {
+	op := string(ri.Op)
+	if !isKnownOp(ri.Op) {
+		op = "unknown"
+	}
+	repo := metrics.RepoLabel(ri.Repo)
+	metrics.Requests.WithLabelValues(op, repo, result).Inc()
+	if result == metrics.ResultOk || result == metrics.ResultFailed {
+		metrics.RequestDuration.WithLabelValues(op, repo).Observe(took.Seconds())
+	}
+}
+
+//countBackendError counts errors from the storage backend. Missing files are
+//expected (restic checks for files before creating them) so are not counted
+func countBackendError(op rns.NatsCommand, err error) {
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	metrics.BackendErrors.WithLabelValues(string(op)).Inc()
+}
@@ -0,0 +1,41 @@
+package worker
+
+import (
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//errInvalidPath is returned for paths that are absolute, climb out of the Repository or have no name
+var errInvalidPath = errors.New("Invalid Path")
+
+//repoPath joins the path elements a client sent, and returns the path relative to the
+//Repository. Absolute paths and .. are refused rather than cleaned, so a request can
+//never reach another Repository or outside the Repository directory
+func repoPath(elems ...string) (string, error) {
+	for _, elem := range elems {
+		if strings.HasPrefix(elem, "/") {
+			return "", errors.Wrapf(errInvalidPath, "%s is absolute", elem)
+		}
+		for _, part := range strings.Split(elem, "/") {
+			if part == ".." {
+				return "", errors.Wrapf(errInvalidPath, "%s is outside the Repository", elem)
+			}
+		}
+	}
+	return path.Join(elems...), nil
+}
+
+//repoFile is repoPath for a file, which must have a name
+func repoFile(dir, name string) (string, error) {
+	if path.Clean(name) == "." {
+		return "", errors.Wrap(errInvalidPath, "No File Name")
+	}
+	return repoPath(dir, name)
+}
+
+//validRepoName reports if a Repository name is a single path element
+func validRepoName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
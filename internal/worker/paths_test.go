@@ -0,0 +1,184 @@
+package worker
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	rns "github.com/Fishwaldo/restic-nats"
+)
+
+func TestRepoPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		dir     string
+		file    string
+		want    string
+		wantErr bool
+	}{
+		{"file", "data", "abc", "data/abc", false},
+		{"cleaned", "./data/", "abc", "data/abc", false},
+		{"no dir", "", "config", "config", false},
+		{"parent in dir", "../other", "config", "", true},
+		{"parent in name", "locks", "../data/abc", "", true},
+		{"parent inside", "data/../../other", "abc", "", true},
+		{"absolute dir", "/etc", "passwd", "", true},
+		{"absolute name", "", "/etc/passwd", "", true},
+		{"no name", "data", "", "", true},
+		{"dot name", "data", ".", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := repoFile(tt.dir, tt.file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("repoFile(%q, %q) error = %v, want error %t", tt.dir, tt.file, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("repoFile(%q, %q) = %q, want %q", tt.dir, tt.file, got, tt.want)
+			}
+		})
+	}
+	if dir, err := repoPath(""); err != nil || dir != "" {
+		t.Errorf("repoPath(\"\") = %q, %v, want the Repository root", dir, err)
+	}
+}
+
+func TestValidRepoName(t *testing.T) {
+	for name, want := range map[string]bool{"backup": true, "my-repo": true, "": false, ".": false, "..": false, "../other": false, "a/b": false, "/etc": false} {
+		if got := validRepoName(name); got != want {
+			t.Errorf("validRepoName(%q) = %t, want %t", name, got, want)
+		}
+	}
+}
+
+//chdirRepos changes to a new directory with the Repositories backup and other, as the localfs backend expects
+func chdirRepos(t *testing.T) (secret string) {
+	t.Helper()
+	dir := t.TempDir()
+	for _, d := range []string{"repo/backup/data", "repo/backup/locks", "repo/other/data"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	secret = filepath.Join(dir, "repo/other/data/secret")
+	if err := os.WriteFile(secret, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(pwd) })
+	return secret
+}
+
+func TestOpsStayInRepository(t *testing.T) {
+	secret := chdirRepos(t)
+	wd := &Worker{}
+	ctx := context.Background()
+	rnsclient := rns.Client{ClientID: "test", Bucket: "backup"}
+	ops := []struct {
+		name string
+		run  func() (bool, error)
+	}{
+		{"stat parent", func() (bool, error) {
+			r, err := wd.Stat(ctx, rnsclient, rns.StatOp{Filename: "../other/data/secret"})
+			return r.Ok, err
+		}},
+		{"stat absolute", func() (bool, error) {
+			r, err := wd.Stat(ctx, rnsclient, rns.StatOp{Filename: "/etc/passwd"})
+			return r.Ok, err
+		}},
+		{"stat no name", func() (bool, error) {
+			r, err := wd.Stat(ctx, rnsclient, rns.StatOp{})
+			return r.Ok, err
+		}},
+		{"mkdir parent", func() (bool, error) {
+			r, err := wd.Mkdir(ctx, rnsclient, rns.MkdirOp{Dir: "../other/new"})
+			return r.Ok, err
+		}},
+		{"mkdir absolute", func() (bool, error) {
+			r, err := wd.Mkdir(ctx, rnsclient, rns.MkdirOp{Dir: "/tmp/new"})
+			return r.Ok, err
+		}},
+		{"save parent dir", func() (bool, error) {
+			r, err := wd.Save(ctx, rnsclient, rns.SaveOp{Dir: "../other/data", Name: "secret", Filesize: 4, Data: []byte("evil")})
+			return r.Ok, err
+		}},
+		{"save parent name", func() (bool, error) {
+			r, err := wd.Save(ctx, rnsclient, rns.SaveOp{Dir: "data", Name: "../../other/data/secret", Filesize: 4, Data: []byte("evil")})
+			return r.Ok, err
+		}},
+		{"save no name", func() (bool, error) {
+			r, err := wd.Save(ctx, rnsclient, rns.SaveOp{Dir: "data", Filesize: 4, Data: []byte("evil")})
+			return r.Ok, err
+		}},
+		{"list parent", func() (bool, error) {
+			r, err := wd.List(ctx, rnsclient, rns.ListOp{BaseDir: "../other/data"})
+			return r.Ok, err
+		}},
+		{"list absolute", func() (bool, error) {
+			r, err := wd.List(ctx, rnsclient, rns.ListOp{BaseDir: "/etc"})
+			return r.Ok, err
+		}},
+		{"load parent", func() (bool, error) {
+			r, err := wd.Load(ctx, rnsclient, rns.LoadOp{Dir: "../other/data", Name: "secret"})
+			return r.Ok, err
+		}},
+		{"load no name", func() (bool, error) {
+			r, err := wd.Load(ctx, rnsclient, rns.LoadOp{Dir: "data"})
+			return r.Ok, err
+		}},
+		{"remove parent", func() (bool, error) {
+			r, err := wd.Remove(ctx, rnsclient, rns.RemoveOp{Dir: "locks", Name: "../../other/data/secret"})
+			return r.Ok, err
+		}},
+		{"remove no name", func() (bool, error) {
+			r, err := wd.Remove(ctx, rnsclient, rns.RemoveOp{Dir: "data"})
+			return r.Ok, err
+		}},
+	}
+	for _, tt := range ops {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := tt.run()
+			if ok || err == nil {
+				t.Fatalf("got Ok %t, error %v, want the request refused", ok, err)
+			}
+			if data, err := os.ReadFile(secret); err != nil || string(data) != "secret" {
+				t.Fatalf("other Repository changed: %q, %v", data, err)
+			}
+		})
+	}
+	if _, err := os.Stat("repo/other/new"); err == nil {
+		t.Error("Mkdir created a directory in another Repository")
+	}
+}
+
+func TestOpsInRepository(t *testing.T) {
+	chdirRepos(t)
+	wd := &Worker{}
+	ctx := context.Background()
+	rnsclient := rns.Client{ClientID: "test", Bucket: "backup"}
+	if r, err := wd.Mkdir(ctx, rnsclient, rns.MkdirOp{Dir: "snapshots"}); !r.Ok || err != nil {
+		t.Fatalf("Mkdir: %t, %v", r.Ok, err)
+	}
+	if r, err := wd.Save(ctx, rnsclient, rns.SaveOp{Dir: "data", Name: "abc", Filesize: 4, Data: []byte("data")}); !r.Ok || err != nil {
+		t.Fatalf("Save: %t, %v", r.Ok, err)
+	}
+	if r, err := wd.Stat(ctx, rnsclient, rns.StatOp{Filename: "data/abc"}); !r.Ok || err != nil || r.Size != 4 {
+		t.Fatalf("Stat: %+v, %v", r, err)
+	}
+	if r, err := wd.List(ctx, rnsclient, rns.ListOp{BaseDir: "data"}); !r.Ok || err != nil || len(r.FI) != 1 {
+		t.Fatalf("List: %+v, %v", r, err)
+	}
+	if r, err := wd.Load(ctx, rnsclient, rns.LoadOp{Dir: "data", Name: "abc"}); !r.Ok || err != nil || string(r.Data) != "data" {
+		t.Fatalf("Load: %+v, %v", r, err)
+	}
+	if r, err := wd.Remove(ctx, rnsclient, rns.RemoveOp{Dir: "data", Name: "abc"}); !r.Ok || err != nil {
+		t.Fatalf("Remove: %t, %v", r.Ok, err)
+	}
+}
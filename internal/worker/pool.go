@@ -0,0 +1,348 @@
+package worker
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Fishwaldo/go-logadapter"
+	rns "github.com/Fishwaldo/restic-nats"
+	"github.com/Fishwaldo/restic-nats-server/internal"
+	"github.com/Fishwaldo/restic-nats-server/internal/metrics"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var poolStats = expvar.NewMap("workerpool")
+
+//pools are all the worker pools that have been started. StartWorker sets them
+//once they are all running, as the health checks read them at any time
+var (
+	pools   []*pool
+	poolsMx sync.RWMutex
+)
+
+//startedPools returns the worker pools that have been started
+func startedPools() []*pool {
+	poolsMx.RLock()
+	defer poolsMx.RUnlock()
+	return pools
+}
+
+//setPools publishes the worker pools once they have been started
+func setPools(started []*pool) {
+	poolsMx.Lock()
+	defer poolsMx.Unlock()
+	pools = started
+}
+
+//validatePoolConfig fills in the pool sizes that were not configured.
+//Without minworkers/maxworkers the pool is a fixed size of number
+func validatePoolConfig(wc *internal.PoolConfigT) error {
+	if wc.NumWorkers < 0 || wc.MinWorkers < 0 || wc.MaxWorkers < 0 {
+		return errors.New("Number of Workers can not be negative")
+	}
+	if wc.NumWorkers == 0 {
+		wc.NumWorkers = 1
+	}
+	if wc.MinWorkers == 0 {
+		wc.MinWorkers = wc.NumWorkers
+		if wc.MaxWorkers > 0 && wc.MaxWorkers < wc.MinWorkers {
+			wc.MinWorkers = wc.MaxWorkers
+		}
+	}
+	if wc.MaxWorkers == 0 {
+		wc.MaxWorkers = wc.NumWorkers
+		if wc.MaxWorkers < wc.MinWorkers {
+			wc.MaxWorkers = wc.MinWorkers
+		}
+	}
+	if wc.MinWorkers > wc.MaxWorkers {
+		return errors.Errorf("minworkers (%d) can not be greater than maxworkers (%d)", wc.MinWorkers, wc.MaxWorkers)
+	}
+	return nil
+}
+
+//validateWorkerConfig checks the worker pools and fills in the defaults
+func validateWorkerConfig(wc *internal.WorkerConfigT) error {
+	if err := validatePoolConfig(&wc.PoolConfigT); err != nil {
+		return err
+	}
+	if wc.Bulk != nil {
+		if err := validatePoolConfig(wc.Bulk); err != nil {
+			return errors.Wrap(err, "bulk")
+		}
+	}
+	if wc.ScaleInterval <= 0 {
+		wc.ScaleInterval = 5 * time.Second
+	}
+	if wc.TargetWait <= 0 {
+		wc.TargetWait = time.Second
+	}
+	if wc.ShutdownGrace < 0 {
+		return errors.New("shutdowngrace can not be negative")
+	}
+	return nil
+}
+
+//pool is a group of Workers processing messages from a queue. The pool grows
+//and shrinks between its minimum and maximum size depending on how many
+//messages are waiting and how long they take to process
+type pool struct {
+	name     string
+	min, max int
+	queue    chan *nats.Msg
+	log      logadapter.Logger
+
+	mx       sync.Mutex
+	workers  map[int]*Worker
+	nextID   int
+	latency  time.Duration
+	busy     int64
+	peakBusy int64
+
+	size      expvar.Int
+	scaleUp   expvar.Int
+	scaleDown expvar.Int
+}
+
+func newPool(name string, min, max int, queue chan *nats.Msg) *pool {
+	p := &pool{
+		name:    name,
+		min:     min,
+		max:     max,
+		queue:   queue,
+		log:     internal.Log.New("pool").With("Pool", name),
+		workers: make(map[int]*Worker),
+	}
+	stats := new(expvar.Map).Init()
+	stats.Set("size", &p.size)
+	stats.Set("scaleup", &p.scaleUp)
+	stats.Set("scaledown", &p.scaleDown)
+	stats.Set("busy", expvar.Func(func() interface{} { return atomic.LoadInt64(&p.busy) }))
+	stats.Set("pending", expvar.Func(func() interface{} { return len(p.queue) }))
+	stats.Set("latency", expvar.Func(func() interface{} { return p.avgLatency().String() }))
+	stats.Set("min", expvar.Func(func() interface{} { return p.min }))
+	stats.Set("max", expvar.Func(func() interface{} { return p.max }))
+	poolStats.Set(name, stats)
+
+	labels := prometheus.Labels{"pool": name}
+	metrics.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "rns", Subsystem: "workerpool", Name: "workers", ConstLabels: labels,
+		Help: "Workers in the pool",
+	}, func() float64 { return float64(p.workerCount()) }))
+	metrics.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "rns", Subsystem: "workerpool", Name: "busy", ConstLabels: labels,
+		Help: "Workers processing a message",
+	}, func() float64 { return float64(atomic.LoadInt64(&p.busy)) }))
+	metrics.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "rns", Subsystem: "workerpool", Name: "queue_depth", ConstLabels: labels,
+		Help: "Messages waiting for a Worker",
+	}, func() float64 { return float64(len(p.queue)) }))
+	return p
+}
+
+//start the initial Workers and the autoscaler
+func (p *pool) start(initial int) {
+	if initial < p.min {
+		initial = p.min
+	}
+	if initial > p.max {
+		initial = p.max
+	}
+	p.grow(initial)
+	p.log.Info("Started %d Workers (Min %d, Max %d)", initial, p.min, p.max)
+	if p.max > p.min {
+		internal.GlobalState.T.Go(p.autoscale)
+	}
+}
+
+func (p *pool) grow(count int) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	for i := 0; i < count; i++ {
+		wd := &Worker{ID: p.nextID,
+			Log:  internal.Log.New("worker").With("ID", p.nextID).With("Pool", p.name),
+			Conn: internal.GlobalState.Conn,
+			pool: p,
+			quit: make(chan struct{}),
+		}
+		p.workers[wd.ID] = wd
+		p.nextID++
+		internal.GlobalState.T.Go(wd.Run)
+	}
+	p.size.Set(int64(len(p.workers)))
+}
+
+//shrink stops count Workers. They exit once they finish their current message
+func (p *pool) shrink(count int) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	for id, wd := range p.workers {
+		if count == 0 {
+			break
+		}
+		close(wd.quit)
+		delete(p.workers, id)
+		count--
+	}
+	p.size.Set(int64(len(p.workers)))
+}
+
+//replace starts a new Worker in place of one that has to exit
+func (p *pool) replace(wd *Worker) {
+	p.mx.Lock()
+	_, running := p.workers[wd.ID]
+	delete(p.workers, wd.ID)
+	p.mx.Unlock()
+	/* if the pool already stopped it, it doesn't need replacing */
+	if running {
+		p.log.Warn("Replacing Worker %d", wd.ID)
+		p.grow(1)
+	}
+}
+
+func (p *pool) workerCount() int {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return len(p.workers)
+}
+
+//begin is called by a Worker when it starts processing a message
+func (p *pool) begin() {
+	busy := atomic.AddInt64(&p.busy, 1)
+	for {
+		peak := atomic.LoadInt64(&p.peakBusy)
+		if busy <= peak || atomic.CompareAndSwapInt64(&p.peakBusy, peak, busy) {
+			return
+		}
+	}
+}
+
+//done is called by a Worker when it has finished processing a message
+func (p *pool) done(took time.Duration) {
+	atomic.AddInt64(&p.busy, -1)
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	/* exponentially weighted moving average of the processing time */
+	if p.latency == 0 {
+		p.latency = took
+	} else {
+		p.latency = (p.latency*7 + took) / 8
+	}
+}
+
+//idle reports if no messages are queued or being processed
+func (p *pool) idle() bool {
+	return len(p.queue) == 0 && atomic.LoadInt64(&p.busy) == 0
+}
+
+func (p *pool) avgLatency() time.Duration {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return p.latency
+}
+
+//autoscale periodically checks the queue and resizes the pool
+func (p *pool) autoscale() error {
+	ticker := time.NewTicker(internal.GlobalState.WorkerConfig.ScaleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-internal.GlobalState.T.Dying():
+			return nil
+		case <-ticker.C:
+			p.scale()
+		}
+	}
+}
+
+func (p *pool) scale() {
+	size := p.workerCount()
+	pending := len(p.queue)
+	busy := int(atomic.LoadInt64(&p.busy))
+	peak := int(atomic.SwapInt64(&p.peakBusy, int64(busy)))
+	latency := p.avgLatency()
+	/* how long a new message would wait before a Worker picks it up */
+	wait := time.Duration(0)
+	if size > 0 {
+		wait = latency * time.Duration(pending) / time.Duration(size)
+	}
+
+	switch {
+	case size < p.max && pending > 0 && (busy >= size || wait > internal.GlobalState.WorkerConfig.TargetWait):
+		grow := pending
+		if grow > p.max-size {
+			grow = p.max - size
+		}
+		p.log.Info("Scaling Up by %d Workers to %d: %d Pending, %d Busy, Latency %s, Estimated Wait %s", grow, size+grow, pending, busy, latency, wait)
+		p.grow(grow)
+		p.scaleUp.Add(1)
+	case size > p.min && pending == 0 && peak < size:
+		p.log.Info("Scaling Down by 1 Worker to %d: Peak %d Busy, Latency %s", size-1, peak, latency)
+		p.shrink(1)
+		p.scaleDown.Add(1)
+	}
+}
+
+//isBulkOp reports if the operation transfers file data, rather than metadata
+func isBulkOp(op rns.NatsCommand) bool {
+	return op == rns.NatsSaveCmd || op == rns.NatsLoadCmd
+}
+
+//routeCommand returns the handler for the subscriptions of a operation, which queues
+//Client Commands for the pool that handles it. Save and Load go to the bulk pool
+//(if configured) so they don't hold up small metadata and lock operations. Each
+//operation has its own subscriptions, so waiting on a full bulk pool doesn't
+//hold up the messages for the other pool either
+func routeCommand(op rns.NatsCommand) nats.MsgHandler {
+	queue := internal.GlobalState.ClientCommand
+	if internal.GlobalState.BulkCommand != nil && isBulkOp(op) {
+		queue = internal.GlobalState.BulkCommand
+	}
+	return func(msg *nats.Msg) {
+		queueCommand(msg, queue)
+	}
+}
+
+//queueCommand queues a Client Command. If the pool is full and messages are
+//backing up in the subscription, the client is told to retry later
+func queueCommand(msg *nats.Msg, queue chan *nats.Msg) {
+	select {
+	case queue <- msg:
+		return
+	default:
+	}
+	/* while we wait, more messages back up in the subscription. Keep checking
+	 * so we start refusing them before NATS has to drop them */
+	ticker := time.NewTicker(busyCheckInterval)
+	defer ticker.Stop()
+	for {
+		if busy, wait := overloaded(msg, queue); busy {
+			replyBusy(msg, wait)
+			return
+		}
+		select {
+		case queue <- msg:
+			return
+		case <-internal.GlobalState.T.Dying():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//stuck returns how many Workers have been processing the same message for longer than limit
+func (p *pool) stuck(limit time.Duration) int {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	count := 0
+	for _, wd := range p.workers {
+		if since := atomic.LoadInt64(&wd.busySince); since != 0 && time.Since(time.Unix(0, since)) > limit {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,38 @@
+package worker
+
+import (
+	"testing"
+
+	"github.com/Fishwaldo/restic-nats-server/internal"
+)
+
+func TestValidatePoolConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      internal.PoolConfigT
+		want    internal.PoolConfigT
+		wantErr bool
+	}{
+		{"defaults", internal.PoolConfigT{}, internal.PoolConfigT{NumWorkers: 1, MinWorkers: 1, MaxWorkers: 1}, false},
+		{"fixed size", internal.PoolConfigT{NumWorkers: 4}, internal.PoolConfigT{NumWorkers: 4, MinWorkers: 4, MaxWorkers: 4}, false},
+		{"max only", internal.PoolConfigT{NumWorkers: 2, MaxWorkers: 8}, internal.PoolConfigT{NumWorkers: 2, MinWorkers: 2, MaxWorkers: 8}, false},
+		{"max below number", internal.PoolConfigT{NumWorkers: 4, MaxWorkers: 2}, internal.PoolConfigT{NumWorkers: 4, MinWorkers: 2, MaxWorkers: 2}, false},
+		{"min only", internal.PoolConfigT{NumWorkers: 2, MinWorkers: 6}, internal.PoolConfigT{NumWorkers: 2, MinWorkers: 6, MaxWorkers: 6}, false},
+		{"min and max", internal.PoolConfigT{NumWorkers: 2, MinWorkers: 1, MaxWorkers: 10}, internal.PoolConfigT{NumWorkers: 2, MinWorkers: 1, MaxWorkers: 10}, false},
+		{"min above max", internal.PoolConfigT{MinWorkers: 5, MaxWorkers: 2}, internal.PoolConfigT{}, true},
+		{"negative number", internal.PoolConfigT{NumWorkers: -1}, internal.PoolConfigT{}, true},
+		{"negative max", internal.PoolConfigT{MaxWorkers: -1}, internal.PoolConfigT{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.in
+			err := validatePoolConfig(&got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validatePoolConfig(%+v) error = %v, want error %t", tt.in, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("validatePoolConfig(%+v) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
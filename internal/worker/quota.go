@@ -0,0 +1,64 @@
+package worker
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Fishwaldo/restic-nats-server/internal"
+	"github.com/Fishwaldo/restic-nats-server/internal/backend/localfs"
+	"github.com/Fishwaldo/restic-nats-server/internal/client"
+	"github.com/Fishwaldo/restic-nats-server/internal/events"
+)
+
+/* Repositories are measured when a Session opens them, and when a Session that
+ * could have written to them is closed. Each process only knows what it measured
+ * itself, so with several Workers the crossing may be reported by each of them */
+
+var (
+	//overQuota - the Repositories that were over events.quotathreshold when they were last measured
+	overQuota = make(map[string]bool)
+	//measuring - the Repositories being measured now
+	measuring = make(map[string]bool)
+	quotaMx   sync.Mutex
+)
+
+//measureRepo counts the size of the Session's Repository in the background, and
+//publishes a Event if it has crossed events.quotathreshold since it was last measured
+func measureRepo(session client.Session) {
+	threshold := events.QuotaThresholdBytes()
+	if threshold == 0 {
+		return
+	}
+	quotaMx.Lock()
+	if measuring[session.Bucket] {
+		quotaMx.Unlock()
+		return
+	}
+	measuring[session.Bucket] = true
+	quotaMx.Unlock()
+	go func() {
+		size, err := localfs.FSSize(context.Background(), session.Bucket)
+		quotaMx.Lock()
+		delete(measuring, session.Bucket)
+		quotaMx.Unlock()
+		if err != nil {
+			internal.Log.Warn("Can't Measure Repository %s: %s", session.Bucket, err)
+			return
+		}
+		if crossedQuota(session.Bucket, size, threshold) {
+			internal.Log.Warn("Repository %s is %d bytes, over the Quota Threshold of %d bytes", session.Bucket, size, threshold)
+			sessionEvent(events.QuotaThreshold, session, "", size)
+		}
+	}()
+}
+
+//crossedQuota records the size of a Repository, and reports if it has gone over
+//threshold since it was last measured. It can be reported again once it has dropped below
+func crossedQuota(repo string, size, threshold int64) bool {
+	quotaMx.Lock()
+	defer quotaMx.Unlock()
+	over := size >= threshold
+	crossed := over && !overQuota[repo]
+	overQuota[repo] = over
+	return crossed
+}
@@ -0,0 +1,48 @@
+package worker
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Fishwaldo/restic-nats-server/internal/backend/localfs"
+)
+
+func TestCrossedQuota(t *testing.T) {
+	defer func() { delete(overQuota, "quotarepo") }()
+	steps := []struct {
+		size int64
+		want bool
+	}{
+		{50, false},
+		{100, true},
+		/* only reported once while it stays over */
+		{150, false},
+		{99, false},
+		{120, true},
+	}
+	for i, step := range steps {
+		if got := crossedQuota("quotarepo", step.size, 100); got != step.want {
+			t.Errorf("step %d: crossedQuota(%d) = %t, want %t", i, step.size, got, step.want)
+		}
+	}
+}
+
+func TestRepoSize(t *testing.T) {
+	secret := chdirRepos(t)
+	if err := os.WriteFile(filepath.Join(filepath.Dir(secret), "more"), make([]byte, 100), 0600); err != nil {
+		t.Fatal(err)
+	}
+	/* "secret" and the 100 bytes in "more" */
+	size, err := localfs.FSSize(context.Background(), "other")
+	if err != nil || size != 106 {
+		t.Errorf("FSSize(other) = %d, %v, want 106", size, err)
+	}
+	if size, err := localfs.FSSize(context.Background(), "backup"); err != nil || size != 0 {
+		t.Errorf("FSSize(backup) = %d, %v, want 0", size, err)
+	}
+	if _, err := localfs.FSSize(context.Background(), "missing"); err == nil {
+		t.Error("FSSize(missing) returned no error")
+	}
+}
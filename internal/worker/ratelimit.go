@@ -0,0 +1,139 @@
+package worker
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	rns "github.com/Fishwaldo/restic-nats"
+	"github.com/Fishwaldo/restic-nats-server/internal/backend/localfs"
+	"github.com/Fishwaldo/restic-nats-server/internal/client"
+	"github.com/Fishwaldo/restic-nats-server/internal/hosts"
+	"github.com/Fishwaldo/restic-nats-server/internal/metrics"
+	"github.com/nats-io/nats.go"
+	"golang.org/x/time/rate"
+)
+
+//minBytesBurst is the smallest burst we allow when only bytespersec is set, so
+//a single restic pack file doesn't always get throttled
+const minBytesBurst = 16 * 1024 * 1024
+
+var throttledStats = expvar.NewMap("throttled")
+
+//hostLimiter is the token buckets for a single Host
+type hostLimiter struct {
+	ops   *rate.Limiter
+	bytes *rate.Limiter
+}
+
+var (
+	limiters  = make(map[string]*hostLimiter)
+	limiterMx sync.Mutex
+)
+
+//getLimiter returns the token buckets for a Host, or nil if the Host is not rate limited
+func getLimiter(account, user string) *hostLimiter {
+	name := hosts.Name(account, user)
+	limiterMx.Lock()
+	defer limiterMx.Unlock()
+	if hl, ok := limiters[name]; ok {
+		return hl
+	}
+	host := hosts.Find(account, user)
+	var hl *hostLimiter
+	if host.OpsPerSec > 0 || host.BytesPerSec > 0 {
+		hl = &hostLimiter{}
+		if host.OpsPerSec > 0 {
+			burst := host.OpsBurst
+			if burst == 0 {
+				burst = int(math.Ceil(host.OpsPerSec))
+			}
+			hl.ops = rate.NewLimiter(rate.Limit(host.OpsPerSec), burst)
+		}
+		if host.BytesPerSec > 0 {
+			burst := host.BytesBurst
+			if burst == 0 {
+				burst = host.BytesPerSec
+				if burst < minBytesBurst {
+					burst = minBytesBurst
+				}
+			}
+			hl.bytes = rate.NewLimiter(rate.Limit(host.BytesPerSec), burst)
+		}
+	}
+	limiters[name] = hl
+	return hl
+}
+
+//throttle takes tokens for a Save or Load request from the Host's buckets.
+//If there are not enough tokens, nothing is taken and the client is told
+//how long to wait before retrying
+func (wd *Worker) throttle(ri requestInfo, msg *nats.Msg, session client.Session) *statusError {
+	hl := getLimiter(ri.Account, ri.User)
+	if hl == nil {
+		return nil
+	}
+	now := time.Now()
+	var reservations []*rate.Reservation
+	cancel := func() {
+		for _, r := range reservations {
+			r.CancelAt(now)
+		}
+	}
+	if hl.ops != nil {
+		reservations = append(reservations, hl.ops.ReserveN(now, 1))
+	}
+	if hl.bytes != nil {
+		size := wd.requestSize(ri, msg, session)
+		/* a request larger than the burst would never be allowed, so it takes the whole bucket */
+		if size > hl.bytes.Burst() {
+			size = hl.bytes.Burst()
+		}
+		reservations = append(reservations, hl.bytes.ReserveN(now, size))
+	}
+	var wait time.Duration
+	for _, r := range reservations {
+		if delay := r.DelayFrom(now); delay > wait {
+			wait = delay
+		}
+	}
+	if wait > 0 {
+		cancel()
+		name := hosts.Name(ri.Account, ri.User)
+		throttledStats.Add(name, 1)
+		metrics.Throttled.WithLabelValues(name).Inc()
+		return &statusError{Code: statusTooManyRequests, Message: fmt.Sprintf("Rate Limit Exceeded for %s", name), RetryAfter: wait}
+	}
+	return nil
+}
+
+//requestSize estimates how many bytes a Save or Load request will transfer
+func (wd *Worker) requestSize(ri requestInfo, msg *nats.Msg, session client.Session) int {
+	switch ri.Op {
+	case rns.NatsSaveCmd:
+		/* chunked messages are split into equal sized chunks, so this is close enough */
+		if chunks, err := strconv.Atoi(msg.Header.Get(msgHeaderChunk)); err == nil && chunks > 1 {
+			return len(msg.Data) * chunks
+		}
+		return len(msg.Data)
+	case rns.NatsLoadCmd:
+		var lo rns.LoadOp
+		if err := wd.decodeRequest(msg, &lo); err != nil {
+			return 0
+		}
+		if lo.Length > 0 {
+			return lo.Length
+		}
+		fi, err := localfs.FSStat(context.Background(), path.Join(session.Bucket, lo.Dir, lo.Name))
+		if err != nil || fi.Size() <= lo.Offset {
+			return 0
+		}
+		return int(fi.Size() - lo.Offset)
+	}
+	return 0
+}
@@ -0,0 +1,147 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	rns "github.com/Fishwaldo/restic-nats"
+	"github.com/Fishwaldo/restic-nats-server/internal/client"
+	"github.com/Fishwaldo/restic-nats-server/internal/hosts"
+	"github.com/Fishwaldo/restic-nats-server/protocol"
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+//header Key Constant Strings for the messages we recieve from clients
+const (
+	msgHeaderID        string = "X-RNS-MSGID"
+	msgHeaderChunk     string = "X-RNS-CHUNKS"
+	msgHeaderOperation string = "X-RNS-OP"
+	msgHeaderClientID  string = "X-RNS-CLIENTID"
+	msgHeaderNRI       string = "Nats-Request-Info"
+	msgHeaderStatus    string = protocol.HeaderStatus
+	msgHeaderError     string = protocol.HeaderError
+	msgHeaderReadOnly  string = protocol.HeaderReadOnly
+	msgHeaderDeadline  string = "X-RNS-DEADLINE"
+	msgHeaderRetry     string = protocol.HeaderRetryAfter
+)
+
+//requestInfo is the details about a request we get from the message headers
+type requestInfo struct {
+	//MsgID - the Message ID the client assigned to this request
+	MsgID string
+	//Op - The Operation requested
+	Op rns.NatsCommand
+	//ClientID - The Session the request belongs to (empty for Open)
+	ClientID string
+	//Bucket - The Repository the request was routed by (empty if the subject doesn't include it)
+	Bucket string
+	//Account - The Host Account the request came from (set by the NATS server)
+	Account string
+	//User - The Host User that sent the request (set by the NATS server)
+	User string
+	//Repo - The Repository the request is for, from the Subject, Session or Open request
+	Repo string
+	//ReadOnly - The client only intends to read from the Repository (Open only)
+	ReadOnly bool
+}
+
+//nriT is the Nats-Request-Info header the NATS server adds to requests
+//that cross from the Hosts account to the Worker account
+type nriT struct {
+	Acc  string `json:"acc"`
+	User string `json:"user,omitempty"`
+}
+
+type requestInfoKey struct{}
+
+func newRequestInfo(msg *nats.Msg) requestInfo {
+	ri := requestInfo{
+		MsgID:    msg.Header.Get(msgHeaderID),
+		Op:       rns.NatsCommand(msg.Header.Get(msgHeaderOperation)),
+		ClientID: msg.Header.Get(msgHeaderClientID),
+		Bucket:   subjectBucket(msg.Subject),
+	}
+	ri.ReadOnly, _ = strconv.ParseBool(msg.Header.Get(msgHeaderReadOnly))
+	/* the NATS server maps the Host Account into the Subject when it imports the request */
+	ri.Account = subjectAccount(msg.Subject)
+	if hdr := msg.Header.Get(msgHeaderNRI); hdr != "" {
+		var nri nriT
+		if err := json.Unmarshal([]byte(hdr), &nri); err == nil {
+			if nri.Acc != "" {
+				ri.Account = nri.Acc
+			}
+			ri.User = hosts.Resolve(ri.Account, nri.User)
+		}
+	}
+	return ri
+}
+
+//requestRepo works out which Repository a request is for
+func (wd *Worker) requestRepo(ri requestInfo, msg *nats.Msg) string {
+	if ri.Bucket != "" {
+		return ri.Bucket
+	}
+	if ri.Op == rns.NatsOpenCmd {
+		var oo rns.OpenRepoOp
+		if err := wd.decodeRequest(msg, &oo); err == nil {
+			return oo.Bucket
+		}
+		return ""
+	}
+	if session, err := client.FindSession(ri.ClientID); err == nil {
+		return session.Bucket
+	}
+	return ""
+}
+
+//attributes describes the request on its trace span
+func (ri requestInfo) attributes(msg *nats.Msg) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("messaging.system", "nats"),
+		attribute.String("messaging.destination", msg.Subject),
+		attribute.String("rns.op", string(ri.Op)),
+		attribute.String("rns.msgid", ri.MsgID),
+		attribute.String("rns.clientid", ri.ClientID),
+		attribute.String("rns.repo", ri.Repo),
+		attribute.String("rns.account", ri.Account),
+		attribute.String("rns.user", ri.User),
+	}
+}
+
+func withRequestInfo(ctx context.Context, ri requestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, ri)
+}
+
+func getRequestInfo(ctx context.Context) (requestInfo, bool) {
+	ri, ok := ctx.Value(requestInfoKey{}).(requestInfo)
+	return ri, ok
+}
+
+//statusError is returned when we refuse a request before its dispatched.
+//The client gets a reply with the status in the headers
+type statusError struct {
+	Code    int
+	Message string
+	//RetryAfter - How long the client should wait before retrying, if its worth retrying
+	RetryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%d %s", e.Code, e.Message)
+}
+
+//replyStatus sends a reply without a result, with the status and reason in the headers
+func replyStatus(msg *nats.Msg, status *statusError) error {
+	reply := rns.NewRNSReplyMsg(msg)
+	reply.Header.Set(msgHeaderStatus, fmt.Sprintf("%d", status.Code))
+	reply.Header.Set(msgHeaderError, status.Message)
+	if status.RetryAfter > 0 {
+		/* in milliseconds, rounded up so the client doesn't retry too early */
+		reply.Header.Set(msgHeaderRetry, fmt.Sprintf("%d", (status.RetryAfter+time.Millisecond-1)/time.Millisecond))
+	}
+	return msg.RespondMsg(reply)
+}
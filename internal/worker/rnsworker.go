@@ -7,14 +7,20 @@ import (
 	"os"
 	"os/signal"
 	"path"
+	"runtime/debug"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/Fishwaldo/restic-nats-server/internal"
+	"github.com/Fishwaldo/restic-nats-server/internal/audit"
 	"github.com/Fishwaldo/restic-nats-server/internal/backend/localfs"
-	"github.com/Fishwaldo/restic-nats-server/internal/cache"
 	"github.com/Fishwaldo/restic-nats-server/internal/client"
+	"github.com/Fishwaldo/restic-nats-server/internal/events"
+	"github.com/Fishwaldo/restic-nats-server/internal/hosts"
+	"github.com/Fishwaldo/restic-nats-server/internal/metrics"
 	"github.com/Fishwaldo/restic-nats-server/internal/natsserver"
+	"github.com/Fishwaldo/restic-nats-server/internal/tracing"
 	"github.com/nats-io/nats.go"
 
 	"github.com/Fishwaldo/go-logadapter"
@@ -28,6 +34,10 @@ type Worker struct {
 	cancel context.CancelFunc
 	Log    logadapter.Logger
 	Conn   *rns.ResticNatsClient
+	pool   *pool
+	quit   chan struct{}
+	//busySince - when the Worker started processing its current message (UnixNano), 0 if idle
+	busySince int64
 }
 
 func init() {
@@ -35,21 +45,73 @@ func init() {
 	viper.SetDefault("worker.number", 10)
 	viper.SetDefault("worker.connecturl", "nats://localhost:4222")
 	viper.SetDefault("worker.handles", "*")
+	viper.SetDefault("worker.timeouts.default", "120s")
+	viper.SetDefault("worker.scaleinterval", "5s")
+	viper.SetDefault("worker.targetwait", "1s")
+	viper.SetDefault("worker.shutdowngrace", "30s")
+	registerHealthChecks()
 }
 
 func parseConfig(cfg *viper.Viper) error {
 	var err error
 	internal.GlobalState.WorkerConfig.NumWorkers = cfg.GetInt("number")
+	internal.GlobalState.WorkerConfig.MinWorkers = cfg.GetInt("minworkers")
+	internal.GlobalState.WorkerConfig.MaxWorkers = cfg.GetInt("maxworkers")
+	if bulk := cfg.Sub("bulk"); bulk != nil {
+		internal.GlobalState.WorkerConfig.Bulk = &internal.PoolConfigT{
+			NumWorkers: bulk.GetInt("number"),
+			MinWorkers: bulk.GetInt("minworkers"),
+			MaxWorkers: bulk.GetInt("maxworkers"),
+		}
+	}
+	internal.GlobalState.WorkerConfig.ScaleInterval = cfg.GetDuration("scaleinterval")
+	internal.GlobalState.WorkerConfig.TargetWait = cfg.GetDuration("targetwait")
+	internal.GlobalState.WorkerConfig.ShutdownGrace = cfg.GetDuration("shutdowngrace")
 	internal.GlobalState.NatsConfig.NatsURL, err = url.Parse(cfg.GetString("connecturl"))
 	if err != nil {
 		return err
 	}
 	internal.GlobalState.NatsConfig.NatsNKey = cfg.GetString("nkey")
 	internal.GlobalState.NatsConfig.NatsCredfile = cfg.GetString("credfile")
-	//WorkerCfg.Backends = cfg.GetStringSlice("handles")
+	internal.GlobalState.NatsConfig.NatsTLSCA = cfg.GetString("tls.ca")
+	internal.GlobalState.NatsConfig.NatsTLSCert = cfg.GetString("tls.cert")
+	internal.GlobalState.NatsConfig.NatsTLSKey = cfg.GetString("tls.key")
+	if internal.GlobalState.WorkerConfig.Handles, err = parseHandles(cfg.GetStringSlice("handles")); err != nil {
+		return err
+	}
+	for _, repo := range internal.GlobalState.WorkerConfig.Handles {
+		if repo != "*" {
+			metrics.AddRepo(repo)
+		}
+	}
+	if internal.GlobalState.WorkerConfig.Accounts, err = parseAccounts(cfg.GetStringSlice("accounts")); err != nil {
+		return err
+	}
+	parseBackpressure(cfg)
+	if err := parseDedupe(cfg.Sub("dedupe")); err != nil {
+		return err
+	}
+	if err := parseTimeouts(cfg.GetStringMapString("timeouts")); err != nil {
+		return err
+	}
+	if err := parseHooks(cfg); err != nil {
+		return err
+	}
 	return nil
 }
 func validateConfig() (warnings []error, err error) {
+	if err := validateWorkerConfig(&internal.GlobalState.WorkerConfig); err != nil {
+		return nil, err
+	}
+	if err := validateDedupe(); err != nil {
+		return nil, err
+	}
+	if err := validateBackpressure(); err != nil {
+		return nil, err
+	}
+	if err := validateHooks(); err != nil {
+		return nil, err
+	}
 	if viper.GetBool("start-nats-server") &&
 		internal.GlobalState.NatsConfig.NatsURL.String() != "" {
 		warnings = append(warnings, errors.New("Using Internal Nats Server. Ignoring Nats Credentials/URL"))
@@ -65,6 +127,14 @@ func validateConfig() (warnings []error, err error) {
 		if internal.GlobalState.NatsConfig.NatsURL.User.Username() != "" && internal.GlobalState.NatsConfig.NatsCredfile != "" {
 			return nil, errors.New("Cannot Set a Username and Credential file at the same time")
 		}
+		if internal.GlobalState.NatsConfig.NatsNKey != "" && internal.GlobalState.NatsConfig.NatsCredfile != "" {
+			return nil, errors.New("Cannot Set a Nkey and Credential file at the same time")
+		}
+		if internal.GlobalState.NatsConfig.NatsNKey != "" {
+			if err := validateNKey(internal.GlobalState.NatsConfig.NatsNKey); err != nil {
+				return nil, err
+			}
+		}
 		/* stat the Creds File if it exists */
 		if internal.GlobalState.NatsConfig.NatsCredfile != "" {
 			f, err := os.Open(internal.GlobalState.NatsConfig.NatsCredfile)
@@ -73,64 +143,109 @@ func validateConfig() (warnings []error, err error) {
 			}
 			f.Close()
 		}
-
+		if _, err := workerTLSConfig(); err != nil {
+			return nil, err
+		}
 	}
 	return warnings, nil
 }
 
 func StartWorker() {
-	var options []rns.RNSOptions
+	startWorker()
 
-	if internal.GlobalState.NatsConfig.NatsCredfile != "" {
-		options = append(options, rns.WithCredentials(internal.GlobalState.NatsConfig.NatsCredfile))
-	} else if internal.GlobalState.NatsConfig.NatsNKey != "" {
-		//XXX TODO
-		internal.Log.Fatal("NKey Authentication TODO")
-	}
-	options = append(options, rns.WithLogger(internal.Log.New("RNSClient")))
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+
+	s := <-signalChan
+	internal.Log.Warn("Got Shutdown Signal %s", s)
+	shutdown(signalChan)
+}
+
+//startWorker connects to the Nats Server, subscribes to the Client Commands and starts the pools
+func startWorker() {
+	logger := internal.Log.New("RNSClient")
 	host, _ := os.Hostname()
-	options = append(options, rns.WithName(host))
-	options = append(options, rns.WithServer())
+	tlsconfig, err := workerTLSConfig()
+	if err != nil {
+		internal.Log.Fatal("Cannot Load TLS Config: %s", err)
+	}
 
 	internal.Log.Debug("Connecting to %s", internal.GlobalState.NatsConfig.NatsURL)
 
-	conn, err := rns.New(*internal.GlobalState.NatsConfig.NatsURL, options...)
+	var conn *rns.ResticNatsClient
+	if nkeyopt := natsserver.InternalWorkerNKey(); nkeyopt != nil && viper.GetBool("start-nats-server") {
+		conn, err = connectWithNKey(*internal.GlobalState.NatsConfig.NatsURL, nkeyopt, host, tlsconfig, logger)
+	} else if internal.GlobalState.NatsConfig.NatsNKey != "" {
+		internal.Log.Info("Authenticating with NKey %s", internal.GlobalState.NatsConfig.NatsNKey)
+		var nkeyopt nats.Option
+		if nkeyopt, err = nats.NkeyOptionFromSeed(internal.GlobalState.NatsConfig.NatsNKey); err != nil {
+			internal.Log.Fatal("Cannot Load NKey Seed File: %s", err)
+		}
+		conn, err = connectWithNKey(*internal.GlobalState.NatsConfig.NatsURL, nkeyopt, host, tlsconfig, logger)
+	} else {
+		options := []rns.RNSOptions{rns.WithLogger(logger), rns.WithServer(), rns.WithName(host)}
+		if internal.GlobalState.NatsConfig.NatsCredfile != "" {
+			options = append(options, rns.WithCredentials(internal.GlobalState.NatsConfig.NatsCredfile))
+		}
+		if tlsconfig != nil {
+			options = append(options, rns.WithTLSOptions(tlsconfig))
+		}
+		conn, err = rns.New(*internal.GlobalState.NatsConfig.NatsURL, options...)
+	}
 	if err != nil {
 		internal.Log.Fatal("Cannot Create a new RNS Connection: %s", err)
 	}
+	internal.GlobalState.Mx.Lock()
 	internal.GlobalState.Conn = conn
+	internal.GlobalState.Mx.Unlock()
+	conn.Conn.SetErrorHandler(natsErrorHandler)
+	audit.SetConn(conn.Conn)
+	events.SetConn(conn.Conn)
 
 	internal.Log.Debug("Connected to Nats Server %s (%s)", conn.Conn.ConnectedServerName(), conn.Conn.ConnectedClusterName())
 
-	/* setup our Subscription for Client Commands */
-	internal.GlobalState.ClientCommand = make(chan *nats.Msg, 5)
-	sub, err := internal.GlobalState.Conn.Conn.ChanQueueSubscribe("repo.Hosts.commands.*", "workerqueue", internal.GlobalState.ClientCommand)
-	if err != nil {
-		internal.Log.Fatal("Cant Setup Client Command Subscription: %s", err)
-		return
-	}
-	internal.GlobalState.ClientCommandSubscription = sub
+	startDedupe()
 
-	for i := 0; i < internal.GlobalState.WorkerConfig.NumWorkers; i++ {
-		wd := Worker{ID: i,
-			Log:  internal.Log.New("worker").With("ID", i),
-			Conn: internal.GlobalState.Conn}
-		internal.GlobalState.T.Go(wd.Run)
+	/* setup our Subscriptions for Client Commands to the Repositories we handle */
+	internal.GlobalState.ClientCommand = make(chan *nats.Msg, internal.GlobalState.WorkerConfig.QueueSize)
+	if internal.GlobalState.WorkerConfig.Bulk != nil {
+		internal.GlobalState.BulkCommand = make(chan *nats.Msg, internal.GlobalState.WorkerConfig.QueueSize)
 	}
-
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
-
-	s := <-signalChan
-	internal.GlobalState.T.Kill(nil)
-	if err := internal.GlobalState.T.Wait(); err != nil {
-		internal.Log.Warn("Workers Reported Error: %s", err)
+	var subs []*nats.Subscription
+	for _, account := range serveAccounts() {
+		for _, op := range knownOps {
+			for _, subject := range commandSubjects(account, op) {
+				sub, err := conn.Conn.QueueSubscribe(subject, "workerqueue", routeCommand(op))
+				if err != nil {
+					internal.Log.Fatal("Cant Setup Client Command Subscription %s: %s", subject, err)
+					return
+				}
+				if err := setPendingLimits(sub); err != nil {
+					internal.Log.Fatal("Cant Set Pending Limits on Subscription %s: %s", subject, err)
+					return
+				}
+				internal.Log.Debug("Subscribed to Client Commands on %s", subject)
+				subs = append(subs, sub)
+			}
+		}
+		internal.Log.Info("Subscribed to Client Commands from Account %s", account)
 	}
+	setCommandSubscriptions(subs)
 
-	internal.Log.Warn("Got Shutdown Signal %s", s)
-	cache.Shutdown()
-	natsserver.Shutdown()
-	os.Exit(0)
+	wc := internal.GlobalState.WorkerConfig
+	workerPool := newPool("default", wc.MinWorkers, wc.MaxWorkers, internal.GlobalState.ClientCommand)
+	workerPool.start(wc.NumWorkers)
+	started := []*pool{workerPool}
+	if wc.Bulk != nil {
+		bulkPool := newPool("bulk", wc.Bulk.MinWorkers, wc.Bulk.MaxWorkers, internal.GlobalState.BulkCommand)
+		bulkPool.start(wc.Bulk.NumWorkers)
+		started = append(started, bulkPool)
+	}
+	setPools(started)
+	if client.IdleTimeout() > 0 {
+		internal.GlobalState.T.Go(expireSessions)
+	}
+	startHooks()
 }
 
 func (wd *Worker) Run() error {
@@ -141,27 +256,112 @@ func (wd *Worker) Run() error {
 		return err
 	}
 
+	var ctx context.Context
+	ctx, wd.cancel = context.WithCancel(context.Background())
+	defer wd.cancel()
 	for {
-		var ctx context.Context
-		ctx, wd.cancel = context.WithCancel(context.Background())
 		var msg *nats.Msg
 		select {
 		case <-internal.GlobalState.T.Dying():
 			wd.Log.Warn("Killing Worker")
-			wd.cancel()
 			return nil
-		case msg = <-internal.GlobalState.ClientCommand:
+		case <-wd.quit:
+			wd.Log.Trace("Worker Stopped")
+			return nil
+		case msg = <-wd.pool.queue:
 		}
-		jobctx, _ := context.WithTimeout(ctx, 120*time.Second)
+		wd.pool.begin()
 		start := time.Now()
+		atomic.StoreInt64(&wd.busySince, start.UnixNano())
+		panicked := wd.process(ctx, rnsServer, msg)
+		atomic.StoreInt64(&wd.busySince, 0)
+		wd.pool.done(time.Since(start))
+		if panicked {
+			/* the Worker may be left in a bad state, so start a fresh one */
+			wd.pool.replace(wd)
+			return nil
+		}
+	}
+}
+
+//process a single message from the queue. A panic while processing the
+//message is recovered, and reported so the Worker can be replaced
+func (wd *Worker) process(ctx context.Context, rnsServer rns.RNSServer, msg *nats.Msg) (panicked bool) {
+	ri := newRequestInfo(msg)
+	ri.Repo = wd.requestRepo(ri, msg)
+	/* continue the trace the client started, if it sent one */
+	ctx, span := tracing.StartSpan(tracing.Extract(ctx, msg.Header), "rns."+string(ri.Op), ri.attributes(msg)...)
+	rec := newAuditRecord(ri)
+	var err error
+	var took time.Duration
+	result := metrics.ResultOk
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			err = errors.Errorf("Panic: %v", r)
+			result = metrics.ResultFailed
+			wd.Log.Error("Panic Processing %s Request %s from %s (Session %s, Repository %s): %v\n%s", ri.Op, ri.MsgID, hosts.Name(ri.Account, ri.User), ri.ClientID, ri.Repo, r, debug.Stack())
+			metrics.Panics.WithLabelValues(string(ri.Op)).Inc()
+			if err := replyStatus(msg, &statusError{Code: statusInternalError, Message: "Internal Server Error"}); err != nil {
+				wd.Log.Warn("Reply Status Failed: %s", err)
+			}
+		}
+		/* the operation may have failed even if the reply was sent */
+		if result == metrics.ResultOk && rec.Error != "" {
+			result = metrics.ResultFailed
+		}
+		observeRequest(ri, result, took)
+		writeAudit(rec, result, err)
+		tracing.EndSpan(span, err)
+	}()
 
-		if err := rnsServer.ProcessServerMsg(jobctx, msg); err != nil {
-			wd.Log.Warn("Process Client Message Failed: %s", err)
-			continue
+	if wd.forward(ri, msg) {
+		result = metrics.ResultForwarded
+		return
+	}
+	if serr := wd.admit(ri, msg); serr != nil {
+		err = serr
+		result = metrics.ResultRefused
+		wd.Log.Warn("Refused %s Request from %s: %s", ri.Op, hosts.Name(ri.Account, ri.User), serr)
+		if err := replyStatus(msg, serr); err != nil {
+			wd.Log.Warn("Reply Status Failed: %s", err)
 		}
-		wd.Log.Info("Command Took %s", time.Since(start))
+		return
 	}
-	return nil
+	deadline, ok := requestDeadline(ri, msg)
+	if !ok {
+		err = errors.New("Client Deadline has already passed")
+		result = metrics.ResultExpired
+		wd.Log.Warn("Dropping %s Request %s: %s", ri.Op, ri.MsgID, err)
+		return
+	}
+	jobctx, cancel := context.WithDeadline(withAuditRecord(withRequestInfo(ctx, ri), rec), deadline)
+	defer cancel()
+	start := time.Now()
+
+	err = rnsServer.ProcessServerMsg(jobctx, msg)
+	took = time.Since(start)
+	if err != nil {
+		result = metrics.ResultFailed
+		wd.Log.Warn("Process Client Message Failed: %s", err)
+		return
+	}
+	wd.Log.Info("Command Took %s", took)
+	return false
+}
+
+//commandSubscriptions returns the Client Command subscriptions StartWorker has set up
+func commandSubscriptions() []*nats.Subscription {
+	internal.GlobalState.Mx.Lock()
+	defer internal.GlobalState.Mx.Unlock()
+	return internal.GlobalState.ClientCommandSubscriptions
+}
+
+//setCommandSubscriptions publishes the Client Command subscriptions once they are all set up
+func setCommandSubscriptions(subs []*nats.Subscription) {
+	internal.GlobalState.Mx.Lock()
+	defer internal.GlobalState.Mx.Unlock()
+	internal.GlobalState.ClientCommandSubscriptions = subs
 }
 
 func (wd *Worker) LookupClient(clientid string) (rns.Client, error) {
@@ -169,27 +369,51 @@ func (wd *Worker) LookupClient(clientid string) (rns.Client, error) {
 }
 
 func (wd *Worker) Open(ctx context.Context, oo rns.OpenRepoOp) (rns.OpenRepoResult, rns.Client, error) {
-	_, err := localfs.FSStat(oo.Bucket)
+	_, err := localfs.FSStat(ctx, oo.Bucket)
 	or := rns.OpenRepoResult{}
 	if err != nil {
 		or.Err = errors.New("Repository Not Found")
+		auditOp(ctx, "", 0, err)
 		return or, rns.Client{}, errors.New("Failed to Open Repository")
 	}
+	metrics.AddRepo(oo.Bucket)
 
-	/* create a new Client */
-	rnsclient, err := client.Create(oo)
+	ri, _ := getRequestInfo(ctx)
+	if err := preHooks(ctx, client.Session{Client: rns.Client{Bucket: oo.Bucket}, Account: ri.Account, User: ri.User, Hostname: oo.Hostname}, "", 0); err != nil {
+		auditOp(ctx, "", 0, err)
+		return or, rns.Client{}, err
+	}
+
+	/* create a new Client, recording the Host User and their Role */
+	host := hosts.Find(ri.Account, ri.User)
+	session, err := client.Create(oo, client.WithAccount(host.Account), client.WithUser(host.Username), client.WithHostname(oo.Hostname), client.WithRole(host.Role), client.WithReadOnly(ri.ReadOnly))
 	if err != nil {
+		auditOp(ctx, "", 0, err)
 		return or, rns.Client{}, errors.Wrap(err, "ClientCreate")
 	}
 	or.Ok = true
-	or.ClientID = rnsclient.ClientID
+	or.ClientID = session.ClientID
+	auditSession(ctx, session.ClientID)
+	sessionEvent(events.SessionOpened, session, "", 0)
+	measureRepo(session)
+	postHooks(ctx, session, "", 0)
+	wd.Log.Debug("Opened Session %s for %s on %s (ReadOnly: %t, %d Sessions Open)", session.ClientID, hosts.Name(session.Account, session.User), session.Bucket, session.ReadOnly, client.Counts().Total)
 
-	return or, rnsclient, nil
+	return or, session.Client, nil
 }
 
-func (wd *Worker) Stat(ctx context.Context, rnsclient rns.Client, so rns.StatOp) (rns.StatResult, error) {
-	fs, err := localfs.FSStat(path.Join(rnsclient.Bucket, so.Filename))
+func (wd *Worker) Stat(ctx context.Context, rnsclient rns.Client, so rns.StatOp) (_ rns.StatResult, err error) {
+	defer func() { auditOp(ctx, so.Filename, 0, err) }()
+	file, err := repoFile("", so.Filename)
+	if err != nil {
+		return rns.StatResult{Ok: false}, err
+	}
+	if err := preHooks(ctx, requestSession(ctx, rnsclient), file, 0); err != nil {
+		return rns.StatResult{Ok: false}, err
+	}
+	fs, err := localfs.FSStat(ctx, path.Join(rnsclient.Bucket, file))
 	if err != nil {
+		countBackendError(rns.NatsStatCmd, err)
 		return rns.StatResult{Ok: false}, errors.Wrap(err, "Stat")
 	}
 	sr := rns.StatResult{
@@ -197,49 +421,104 @@ func (wd *Worker) Stat(ctx context.Context, rnsclient rns.Client, so rns.StatOp)
 		Name: fs.Name(),
 		Size: fs.Size(),
 	}
+	postHooks(ctx, requestSession(ctx, rnsclient), file, 0)
 	return sr, nil
 }
-func (wd *Worker) Mkdir(ctx context.Context, rnsclient rns.Client, mo rns.MkdirOp) (rns.MkdirResult, error) {
-	path := path.Join(rnsclient.Bucket, mo.Dir)
-	if err := localfs.FSMkDir(path); err != nil {
+func (wd *Worker) Mkdir(ctx context.Context, rnsclient rns.Client, mo rns.MkdirOp) (_ rns.MkdirResult, err error) {
+	defer func() { auditOp(ctx, mo.Dir, 0, err) }()
+	dir, err := repoPath(mo.Dir)
+	if err != nil {
+		return rns.MkdirResult{Ok: false}, err
+	}
+	if err := preHooks(ctx, requestSession(ctx, rnsclient), dir, 0); err != nil {
+		return rns.MkdirResult{Ok: false}, err
+	}
+	if err := localfs.FSMkDir(ctx, path.Join(rnsclient.Bucket, dir)); err != nil {
+		countBackendError(rns.NatsMkdirCmd, err)
 		return rns.MkdirResult{Ok: false}, errors.Wrap(err, "Mkdir")
 	}
+	postHooks(ctx, requestSession(ctx, rnsclient), dir, 0)
 	return rns.MkdirResult{Ok: true}, nil
 }
 
 func (wd *Worker) Save(ctx context.Context, rnsclient rns.Client, so rns.SaveOp) (rns.SaveResult, error) {
-	path := path.Join(rnsclient.Bucket, so.Dir, so.Name)
-	len, err := localfs.FSSave(path, &so.Data)
+	ok, err := dedupe(ctx, path.Join(so.Dir, so.Name), so.Data, fileSaved(ctx, rnsclient, so.Dir, so.Name, len(so.Data)), func() (bool, error) {
+		sr, err := wd.save(ctx, rnsclient, so)
+		return sr.Ok, err
+	})
+	return rns.SaveResult{Ok: ok}, err
+}
+
+func (wd *Worker) save(ctx context.Context, rnsclient rns.Client, so rns.SaveOp) (_ rns.SaveResult, err error) {
+	var len int
+	defer func() { auditOp(ctx, path.Join(so.Dir, so.Name), int64(len), err) }()
+	defer func() {
+		if err != nil {
+			saveFailedEvent(ctx, rnsclient, so.Dir, so.Name, err)
+		}
+	}()
+	file, err := repoFile(so.Dir, so.Name)
 	if err != nil {
+		return rns.SaveResult{Ok: false}, err
+	}
+	if err = preHooks(ctx, requestSession(ctx, rnsclient), file, int64(so.Filesize)); err != nil {
+		return rns.SaveResult{Ok: false}, err
+	}
+	len, err = localfs.FSSave(ctx, path.Join(rnsclient.Bucket, file), &so.Data)
+	if err != nil {
+		countBackendError(rns.NatsSaveCmd, err)
 		return rns.SaveResult{Ok: false}, errors.Wrap(err, "Save")
 	}
 	if len != int(so.Filesize) {
 		return rns.SaveResult{Ok: false}, errors.New("Packetsize != Writtensize")
 	}
+	metrics.Bytes.WithLabelValues("in", metrics.RepoLabel(rnsclient.Bucket)).Add(float64(len))
+	fileEvent(ctx, rnsclient, so.Dir, so.Name, int64(len), true)
+	postHooks(ctx, requestSession(ctx, rnsclient), file, int64(len))
 	return rns.SaveResult{Ok: true}, nil
 }
 
-func (wd *Worker) List(ctx context.Context, rnsclient rns.Client, lo rns.ListOp) (rns.ListResult, error) {
+func (wd *Worker) List(ctx context.Context, rnsclient rns.Client, lo rns.ListOp) (_ rns.ListResult, err error) {
+	defer func() { auditOp(ctx, lo.BaseDir, 0, err) }()
 	var result rns.ListResult
-	fi, err := localfs.FSListFiles(path.Join(rnsclient.Bucket, lo.BaseDir), lo.Recurse)
+	dir, err := repoPath(lo.BaseDir)
 	if err != nil {
+		return rns.ListResult{Ok: false}, err
+	}
+	if err := preHooks(ctx, requestSession(ctx, rnsclient), dir, 0); err != nil {
+		return rns.ListResult{Ok: false}, err
+	}
+	fi, err := localfs.FSListFiles(ctx, path.Join(rnsclient.Bucket, dir), lo.Recurse)
+	if err != nil {
+		countBackendError(rns.NatsListCmd, err)
 		return rns.ListResult{Ok: false}, errors.Wrap(err, "List")
 	}
+	checkStaleLocks(ctx, rnsclient, lo.BaseDir, fi)
 	result.Ok = true
 	result.FI = fi
+	postHooks(ctx, requestSession(ctx, rnsclient), dir, 0)
 	return result, nil
 }
 
-func (wd *Worker) Load(ctx context.Context, rnsclient rns.Client, lo rns.LoadOp) (rns.LoadResult, error) {
-	var result rns.LoadResult
-	rd, err := localfs.FSLoadFile(path.Join(rnsclient.Bucket, lo.Dir, lo.Name))
+func (wd *Worker) Load(ctx context.Context, rnsclient rns.Client, lo rns.LoadOp) (result rns.LoadResult, err error) {
+	defer func() { auditOp(ctx, path.Join(lo.Dir, lo.Name), int64(len(result.Data)), err) }()
+	file, err := repoFile(lo.Dir, lo.Name)
+	if err != nil {
+		return rns.LoadResult{Ok: false}, err
+	}
+	if err := preHooks(ctx, requestSession(ctx, rnsclient), file, 0); err != nil {
+		return rns.LoadResult{Ok: false}, err
+	}
+	rd, err := localfs.FSLoadFile(ctx, path.Join(rnsclient.Bucket, file))
 	if err != nil {
+		countBackendError(rns.NatsLoadCmd, err)
 		return rns.LoadResult{Ok: false}, errors.Wrap(err, "Load")
 	}
 	defer rd.Close()
 	if lo.Offset > 0 {
 		_, err = rd.Seek(lo.Offset, 0)
 		if err != nil {
+			countBackendError(rns.NatsLoadCmd, err)
 			return rns.LoadResult{Ok: false}, errors.Wrap(err, "Seek")
 		}
 	}
@@ -247,6 +526,7 @@ func (wd *Worker) Load(ctx context.Context, rnsclient rns.Client, lo rns.LoadOp)
 		result.Data = make([]byte, lo.Length)
 		len, err := rd.Read(result.Data)
 		if err != nil {
+			countBackendError(rns.NatsLoadCmd, err)
 			return rns.LoadResult{Ok: false}, errors.Wrap(err, "Read")
 		}
 		if len != lo.Length {
@@ -255,25 +535,56 @@ func (wd *Worker) Load(ctx context.Context, rnsclient rns.Client, lo rns.LoadOp)
 	} else {
 		result.Data, err = io.ReadAll(rd)
 		if err != nil {
+			countBackendError(rns.NatsLoadCmd, err)
 			return rns.LoadResult{Ok: false}, errors.Wrap(err, "ReadAll")
 		}
 	}
 	result.Ok = true
+	metrics.Bytes.WithLabelValues("out", metrics.RepoLabel(rnsclient.Bucket)).Add(float64(len(result.Data)))
+	postHooks(ctx, requestSession(ctx, rnsclient), file, int64(len(result.Data)))
 	return result, nil
 }
 
 func (wd *Worker) Remove(ctx context.Context, rnsclient rns.Client, ro rns.RemoveOp) (rns.RemoveResult, error) {
-	var result rns.RemoveResult
-	if err := localfs.FSRemove(path.Join(rnsclient.Bucket, ro.Dir, ro.Name)); err != nil {
+	ok, err := dedupe(ctx, path.Join(ro.Dir, ro.Name), nil, fileRemoved(ctx, rnsclient, ro.Dir, ro.Name), func() (bool, error) {
+		rr, err := wd.remove(ctx, rnsclient, ro)
+		return rr.Ok, err
+	})
+	return rns.RemoveResult{Ok: ok}, err
+}
+
+func (wd *Worker) remove(ctx context.Context, rnsclient rns.Client, ro rns.RemoveOp) (result rns.RemoveResult, err error) {
+	defer func() { auditOp(ctx, path.Join(ro.Dir, ro.Name), 0, err) }()
+	file, err := repoFile(ro.Dir, ro.Name)
+	if err != nil {
+		return rns.RemoveResult{Ok: false}, err
+	}
+	if err := preHooks(ctx, requestSession(ctx, rnsclient), file, 0); err != nil {
+		return rns.RemoveResult{Ok: false}, err
+	}
+	if err := localfs.FSRemove(ctx, path.Join(rnsclient.Bucket, file)); err != nil {
+		countBackendError(rns.NatsRemoveCmd, err)
 		return rns.RemoveResult{Ok: false}, errors.Wrap(err, "Remove")
 	}
+	fileEvent(ctx, rnsclient, ro.Dir, ro.Name, 0, false)
+	postHooks(ctx, requestSession(ctx, rnsclient), file, 0)
 	result.Ok = true
 	return result, nil
 }
 
 func (wd *Worker) Close(ctx context.Context, rnsclient rns.Client, co rns.CloseOp) (rns.CloseResult, error) {
-	if err := client.Remove(rnsclient.ClientID); err != nil {
+	session, err := client.FindSession(rnsclient.ClientID)
+	if err == nil {
+		err = client.Remove(rnsclient.ClientID)
+	}
+	if err != nil {
 		wd.Log.Warn("Can't Find Client %s", rnsclient.ClientID)
+	} else {
+		sessionEvent(events.SessionClosed, session, "", 0)
+		if !session.ReadOnly {
+			measureRepo(session)
+		}
+		postHooks(ctx, session, "", 0)
 	}
 	/* always return success */
 	return rns.CloseResult{Ok: true}, nil
@@ -0,0 +1,92 @@
+package worker
+
+import (
+	"os"
+	"time"
+
+	"github.com/Fishwaldo/restic-nats-server/internal"
+	"github.com/Fishwaldo/restic-nats-server/internal/audit"
+	"github.com/Fishwaldo/restic-nats-server/internal/cache"
+	"github.com/Fishwaldo/restic-nats-server/internal/client"
+	"github.com/Fishwaldo/restic-nats-server/internal/events"
+	"github.com/Fishwaldo/restic-nats-server/internal/httpserver"
+	"github.com/Fishwaldo/restic-nats-server/internal/natsserver"
+	"github.com/Fishwaldo/restic-nats-server/internal/tracing"
+	"github.com/Fishwaldo/restic-nats-server/internal/webhook"
+)
+
+//shutdown stops the Worker gracefully:
+// 1) stop accepting new messages and drain the subscriptions
+// 2) let the queued and in-flight messages finish, within the grace period
+// 3) stop the Workers, wait for post Hooks and close any Sessions that are still open
+// 4) stop the services in the reverse order they were started
+//a second signal skips the grace period
+func shutdown(signalChan chan os.Signal) {
+	for _, sub := range commandSubscriptions() {
+		if err := sub.Drain(); err != nil {
+			internal.Log.Warn("Drain Subscription %s Failed: %s", sub.Subject, err)
+		}
+	}
+
+	grace := internal.GlobalState.WorkerConfig.ShutdownGrace
+	internal.Log.Info("Waiting up to %s for In-Flight Requests to finish", grace)
+	timeout := time.NewTimer(grace)
+	defer timeout.Stop()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+drain:
+	/* messages still pending in a draining subscription have not reached the pools yet */
+	for !subscriptionsDrained() || !poolsIdle() {
+		select {
+		case <-ticker.C:
+		case <-timeout.C:
+			internal.Log.Warn("Grace Period Expired with Requests still In-Flight")
+			break drain
+		case s := <-signalChan:
+			internal.Log.Warn("Got Signal %s. Not waiting for In-Flight Requests", s)
+			break drain
+		}
+	}
+
+	internal.GlobalState.T.Kill(nil)
+	if err := internal.GlobalState.T.Wait(); err != nil {
+		internal.Log.Warn("Workers Reported Error: %s", err)
+	}
+	waitHooks(grace)
+
+	if closed := client.RemoveAll(); closed > 0 {
+		internal.Log.Info("Closed %d Open Sessions", closed)
+	}
+	audit.Shutdown()
+	events.Shutdown()
+	webhook.Shutdown()
+	if internal.GlobalState.Conn != nil {
+		internal.GlobalState.Conn.Conn.Close()
+	}
+
+	httpserver.Shutdown()
+	cache.Shutdown()
+	natsserver.Shutdown()
+	tracing.Shutdown()
+	internal.Log.Info("Shutdown Complete")
+}
+
+//subscriptionsDrained reports if every Client Command subscription has finished draining
+func subscriptionsDrained() bool {
+	for _, sub := range commandSubscriptions() {
+		if sub.IsValid() {
+			return false
+		}
+	}
+	return true
+}
+
+//poolsIdle reports if no messages are queued or being processed
+func poolsIdle() bool {
+	for _, p := range startedPools() {
+		if !p.idle() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,147 @@
+package worker
+
+import (
+	"fmt"
+	"strings"
+
+	rns "github.com/Fishwaldo/restic-nats"
+	"github.com/Fishwaldo/restic-nats-server/internal"
+	"github.com/Fishwaldo/restic-nats-server/internal/client"
+	"github.com/Fishwaldo/restic-nats-server/internal/hosts"
+	"github.com/Fishwaldo/restic-nats-server/internal/natsserver"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+/* Client Commands arrive on one of these subjects:
+ *  repo.<account>.commands.<operation>          - clients that don't route by Repository
+ *  repo.<account>.commands.<bucket>.<operation> - clients that route by Repository
+ *  repo.<account>.sessions.<node>.<operation>   - forwarded by another Worker
+ *
+ * Every Worker subscribes to the plain subject, as the stock client doesn't route
+ * by Repository. A Worker that gets a Open for a Repository it doesn't handle
+ * forwards it to the Repository subject, where a Worker that does handle it picks
+ * it up. The other operations are for a Session, which only the Worker that opened
+ * it knows about (see the client package). The ClientID names that Worker, so they
+ * are forwarded to the session subject for its node.
+ */
+
+//parseHandles validates the list of Repositories from worker.handles
+func parseHandles(handles []string) ([]string, error) {
+	var ret []string
+	for _, repo := range handles {
+		repo = strings.TrimSpace(repo)
+		if repo == "" {
+			continue
+		}
+		if repo != "*" && !validToken(repo) {
+			return nil, errors.Errorf("Invalid Repository Name %s in worker.handles", repo)
+		}
+		ret = append(ret, repo)
+	}
+	if len(ret) == 0 {
+		ret = []string{"*"}
+	}
+	return ret, nil
+}
+
+//parseAccounts validates the list of Host Accounts from worker.accounts
+func parseAccounts(accounts []string) ([]string, error) {
+	var ret []string
+	for _, account := range accounts {
+		account = strings.TrimSpace(account)
+		if account == "" {
+			continue
+		}
+		if !validToken(account) {
+			return nil, errors.Errorf("Invalid Account Name %s in worker.accounts", account)
+		}
+		ret = append(ret, account)
+	}
+	return ret, nil
+}
+
+//validToken reports if name can be used as a single token in a Subject
+func validToken(name string) bool {
+	return name != "" && !strings.ContainsAny(name, ".*> \t\r\n")
+}
+
+//serveAccounts returns the Host Accounts we take Client Commands from. If worker.accounts
+//is not configured, we serve every Host Account in the embedded NATS server, or the
+//default Host Account when connecting to a external server
+func serveAccounts() []string {
+	if len(internal.GlobalState.WorkerConfig.Accounts) > 0 {
+		return internal.GlobalState.WorkerConfig.Accounts
+	}
+	if viper.GetBool("start-nats-server") {
+		return natsserver.HostAccounts()
+	}
+	return []string{hosts.DefaultAccount}
+}
+
+//handlesAll reports if this Worker serves every Repository
+func handlesAll() bool {
+	for _, repo := range internal.GlobalState.WorkerConfig.Handles {
+		if repo == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+//handlesRepo reports if this Worker serves the Repository
+func handlesRepo(repo string) bool {
+	if handlesAll() {
+		return true
+	}
+	for _, handled := range internal.GlobalState.WorkerConfig.Handles {
+		if handled == repo {
+			return true
+		}
+	}
+	return false
+}
+
+//commandSubjects returns the subjects we subscribe to for a operation, for the Repositories we handle
+func commandSubjects(account string, op rns.NatsCommand) []string {
+	/* the plain subject is filtered once the message is decoded, see forward */
+	subjects := []string{fmt.Sprintf("repo.%s.commands.%s", account, op)}
+	if op != rns.NatsOpenCmd {
+		subjects = append(subjects, sessionSubject(account, client.NodeID(), op))
+	}
+	if handlesAll() {
+		return append(subjects, repoSubject(account, "*", op))
+	}
+	for _, repo := range internal.GlobalState.WorkerConfig.Handles {
+		subjects = append(subjects, repoSubject(account, repo, op))
+	}
+	return subjects
+}
+
+//repoSubject is the subject a Client Command for a Repository is routed by
+func repoSubject(account, repo string, op rns.NatsCommand) string {
+	return fmt.Sprintf("repo.%s.commands.%s.%s", account, repo, op)
+}
+
+//sessionSubject is the subject the requests for Sessions opened by node are forwarded to
+func sessionSubject(account, node string, op rns.NatsCommand) string {
+	return fmt.Sprintf("repo.%s.sessions.%s.%s", account, node, op)
+}
+
+//subjectAccount returns the Host Account a message was sent from
+func subjectAccount(subject string) string {
+	tokens := strings.Split(subject, ".")
+	if len(tokens) >= 4 && tokens[0] == "repo" && (tokens[2] == "commands" || tokens[2] == "sessions") {
+		return tokens[1]
+	}
+	return ""
+}
+
+//subjectBucket returns the Repository a message was routed by, if any
+func subjectBucket(subject string) string {
+	tokens := strings.Split(subject, ".")
+	if len(tokens) == 5 && tokens[0] == "repo" && tokens[2] == "commands" {
+		return tokens[3]
+	}
+	return ""
+}
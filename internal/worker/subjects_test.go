@@ -0,0 +1,90 @@
+package worker
+
+import (
+	"reflect"
+	"testing"
+
+	rns "github.com/Fishwaldo/restic-nats"
+	"github.com/Fishwaldo/restic-nats-server/internal"
+	"github.com/Fishwaldo/restic-nats-server/internal/client"
+)
+
+func TestParseHandles(t *testing.T) {
+	tests := []struct {
+		name    string
+		handles []string
+		want    []string
+		wantErr bool
+	}{
+		{"empty handles everything", nil, []string{"*"}, false},
+		{"blank entries", []string{" ", ""}, []string{"*"}, false},
+		{"wildcard", []string{"*"}, []string{"*"}, false},
+		{"repos", []string{" repo1 ", "repo2"}, []string{"repo1", "repo2"}, false},
+		{"dot", []string{"repo.1"}, nil, true},
+		{"embedded wildcard", []string{"repo*"}, nil, true},
+		{"full wildcard", []string{">"}, nil, true},
+		{"space", []string{"my repo"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseHandles(tt.handles)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseHandles(%q) error = %v, want error %t", tt.handles, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseHandles(%q) = %q, want %q", tt.handles, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubjectBucket(t *testing.T) {
+	tests := []struct {
+		subject     string
+		wantBucket  string
+		wantAccount string
+	}{
+		{"repo.Hosts.commands.open", "", "Hosts"},
+		{"repo.Hosts.commands.backup.open", "backup", "Hosts"},
+		{"repo.Office.commands.backup.save", "backup", "Office"},
+		{"repo.Hosts.events.backup.open", "", ""},
+		{"other.Hosts.commands.backup.open", "", ""},
+		{"repo.Hosts.commands.backup.extra.open", "", "Hosts"},
+		{"repo.Hosts.sessions.abcdefgh.save", "", "Hosts"},
+		{"repo.Hosts", "", ""},
+	}
+	for _, tt := range tests {
+		if got := subjectBucket(tt.subject); got != tt.wantBucket {
+			t.Errorf("subjectBucket(%q) = %q, want %q", tt.subject, got, tt.wantBucket)
+		}
+		if got := subjectAccount(tt.subject); got != tt.wantAccount {
+			t.Errorf("subjectAccount(%q) = %q, want %q", tt.subject, got, tt.wantAccount)
+		}
+	}
+}
+
+func TestCommandSubjects(t *testing.T) {
+	session := "repo.Hosts.sessions." + client.NodeID() + ".save"
+	tests := []struct {
+		name    string
+		handles []string
+		want    []string
+	}{
+		{"all", []string{"*"}, []string{"repo.Hosts.commands.save", session, "repo.Hosts.commands.*.save"}},
+		{"repos", []string{"repo1", "repo2"}, []string{"repo.Hosts.commands.save", session, "repo.Hosts.commands.repo1.save", "repo.Hosts.commands.repo2.save"}},
+	}
+	saved := internal.GlobalState.WorkerConfig.Handles
+	defer func() { internal.GlobalState.WorkerConfig.Handles = saved }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			internal.GlobalState.WorkerConfig.Handles = tt.handles
+			if got := commandSubjects("Hosts", rns.NatsSaveCmd); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("commandSubjects = %q, want %q", got, tt.want)
+			}
+			/* a Open doesn't belong to a Session yet */
+			if got := commandSubjects("Hosts", rns.NatsOpenCmd); len(got) != len(tt.want)-1 {
+				t.Errorf("commandSubjects(open) = %q, want no session subject", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package worker
+
+import (
+	"strings"
+	"time"
+
+	rns "github.com/Fishwaldo/restic-nats"
+	"github.com/Fishwaldo/restic-nats-server/internal"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+//defaultTimeout is used when no timeout is configured for an operation
+const defaultTimeout = 120 * time.Second
+
+var knownOps = []rns.NatsCommand{
+	rns.NatsOpenCmd, rns.NatsStatCmd, rns.NatsMkdirCmd, rns.NatsSaveCmd,
+	rns.NatsListCmd, rns.NatsLoadCmd, rns.NatsRemoveCmd, rns.NatsCloseCmd,
+}
+
+//parseTimeouts parses the worker.timeouts config section. Each key is a operation
+//name (or default) and the value is a duration such as "30s"
+func parseTimeouts(cfg map[string]string) error {
+	internal.GlobalState.WorkerConfig.DefaultTimeout = defaultTimeout
+	internal.GlobalState.WorkerConfig.Timeouts = make(map[rns.NatsCommand]time.Duration)
+	for key, value := range cfg {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return errors.Wrapf(err, "Timeout for %s", key)
+		}
+		if timeout <= 0 {
+			return errors.Errorf("Timeout for %s must be greater than 0", key)
+		}
+		key = strings.ToLower(key)
+		if key == "default" {
+			internal.GlobalState.WorkerConfig.DefaultTimeout = timeout
+			continue
+		}
+		if !isKnownOp(rns.NatsCommand(key)) {
+			return errors.Errorf("Timeout for unknown Operation %s", key)
+		}
+		internal.GlobalState.WorkerConfig.Timeouts[rns.NatsCommand(key)] = timeout
+	}
+	return nil
+}
+
+func isKnownOp(op rns.NatsCommand) bool {
+	for _, known := range knownOps {
+		if op == known {
+			return true
+		}
+	}
+	return false
+}
+
+//opTimeout returns the configured timeout for a operation
+func opTimeout(op rns.NatsCommand) time.Duration {
+	if timeout, ok := internal.GlobalState.WorkerConfig.Timeouts[op]; ok {
+		return timeout
+	}
+	if internal.GlobalState.WorkerConfig.DefaultTimeout > 0 {
+		return internal.GlobalState.WorkerConfig.DefaultTimeout
+	}
+	return defaultTimeout
+}
+
+//requestDeadline returns when we should give up on a request. The client may
+//send its own deadline, which can only shorten the configured timeout.
+//returns false if the client deadline has already passed
+func requestDeadline(ri requestInfo, msg *nats.Msg) (time.Time, bool) {
+	deadline := time.Now().Add(opTimeout(ri.Op))
+	if hdr := msg.Header.Get(msgHeaderDeadline); hdr != "" {
+		clientdeadline, err := time.Parse(time.RFC3339Nano, hdr)
+		if err == nil && clientdeadline.Before(deadline) {
+			deadline = clientdeadline
+		}
+	}
+	return deadline, time.Now().Before(deadline)
+}
+
+//maxTimeout returns the longest timeout any operation can have
+func maxTimeout() time.Duration {
+	longest := opTimeout("")
+	for _, timeout := range internal.GlobalState.WorkerConfig.Timeouts {
+		if timeout > longest {
+			longest = timeout
+		}
+	}
+	return longest
+}
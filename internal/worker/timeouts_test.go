@@ -0,0 +1,92 @@
+package worker
+
+import (
+	"testing"
+	"time"
+
+	rns "github.com/Fishwaldo/restic-nats"
+	"github.com/Fishwaldo/restic-nats-server/internal"
+	"github.com/nats-io/nats.go"
+)
+
+func TestParseTimeouts(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         map[string]string
+		wantErr     bool
+		wantDefault time.Duration
+		wantOps     map[rns.NatsCommand]time.Duration
+	}{
+		{"empty", nil, false, defaultTimeout, map[rns.NatsCommand]time.Duration{}},
+		{"default", map[string]string{"default": "30s"}, false, 30 * time.Second, map[rns.NatsCommand]time.Duration{}},
+		{"ops", map[string]string{"Save": "10m", "load": "5m"}, false, defaultTimeout, map[rns.NatsCommand]time.Duration{rns.NatsSaveCmd: 10 * time.Minute, rns.NatsLoadCmd: 5 * time.Minute}},
+		{"unknown op", map[string]string{"rename": "10s"}, true, 0, nil},
+		{"bad duration", map[string]string{"save": "ten"}, true, 0, nil},
+		{"zero", map[string]string{"save": "0s"}, true, 0, nil},
+		{"negative", map[string]string{"default": "-1s"}, true, 0, nil},
+	}
+	saved := internal.GlobalState.WorkerConfig
+	defer func() { internal.GlobalState.WorkerConfig = saved }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := parseTimeouts(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTimeouts(%v) error = %v, want error %t", tt.cfg, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			wc := internal.GlobalState.WorkerConfig
+			if wc.DefaultTimeout != tt.wantDefault {
+				t.Errorf("DefaultTimeout = %s, want %s", wc.DefaultTimeout, tt.wantDefault)
+			}
+			if len(wc.Timeouts) != len(tt.wantOps) {
+				t.Errorf("Timeouts = %v, want %v", wc.Timeouts, tt.wantOps)
+			}
+			for op, want := range tt.wantOps {
+				if got := wc.Timeouts[op]; got != want {
+					t.Errorf("Timeout for %s = %s, want %s", op, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestDeadline(t *testing.T) {
+	saved := internal.GlobalState.WorkerConfig
+	defer func() { internal.GlobalState.WorkerConfig = saved }()
+	if err := parseTimeouts(map[string]string{"default": "1m", "save": "10m"}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	tests := []struct {
+		name      string
+		op        rns.NatsCommand
+		client    string
+		want      time.Duration
+		wantAlive bool
+	}{
+		{"default timeout", rns.NatsStatCmd, "", time.Minute, true},
+		{"op timeout", rns.NatsSaveCmd, "", 10 * time.Minute, true},
+		{"client shortens", rns.NatsSaveCmd, now.Add(30 * time.Second).Format(time.RFC3339Nano), 30 * time.Second, true},
+		{"client can't extend", rns.NatsStatCmd, now.Add(time.Hour).Format(time.RFC3339Nano), time.Minute, true},
+		{"client already passed", rns.NatsStatCmd, now.Add(-time.Second).Format(time.RFC3339Nano), -time.Second, false},
+		{"unparsable client deadline", rns.NatsStatCmd, "soon", time.Minute, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := nats.NewMsg("test")
+			if tt.client != "" {
+				msg.Header.Set(msgHeaderDeadline, tt.client)
+			}
+			deadline, alive := requestDeadline(requestInfo{Op: tt.op}, msg)
+			if alive != tt.wantAlive {
+				t.Errorf("requestDeadline alive = %t, want %t", alive, tt.wantAlive)
+			}
+			/* allow for the time the test takes to run */
+			if diff := deadline.Sub(now.Add(tt.want)); diff < 0 || diff > time.Second {
+				t.Errorf("requestDeadline = %s, want %s from now", deadline.Sub(now), tt.want)
+			}
+		})
+	}
+}
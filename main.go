@@ -1,11 +1,15 @@
 package main
 
 import (
+	"os"
+
 	//"github.com/Fishwaldo/restic-nats-server/cmd/rns"
 	"github.com/Fishwaldo/restic-nats-server/cmd"
 )
 
 func main() {
-	cmd.Execute()
+	if err := cmd.Execute(); err != nil {
+		os.Exit(1)
+	}
 	//rns.StartWorker()
 }
\ No newline at end of file
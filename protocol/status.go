@@ -0,0 +1,25 @@
+// Package protocol describes the additions restic-nats-server makes to the restic-nats protocol.
+//
+// When a Worker refuses a request before it is processed, for example because the Role of
+// the Host User does not allow it, the reply has no result. The status is in these headers:
+//
+//	X-RNS-STATUS       a HTTP style status code, such as 403 or 429
+//	X-RNS-ERROR        the reason the request was refused
+//	X-RNS-RETRY-AFTER  milliseconds the client should wait before retrying. Only sent when retrying is worth it,
+//	                   such as when the server is busy (503) or a rate limit is reached
+//
+// Clients that don't check the headers see a reply they can't decode.
+//
+// Clients can open a read only Session by setting X-RNS-READONLY to true on the Open request.
+// Operations that change the Repository are then refused with 403.
+package protocol
+
+//Headers on replies to refused requests
+const (
+	HeaderStatus     = "X-RNS-STATUS"
+	HeaderError      = "X-RNS-ERROR"
+	HeaderRetryAfter = "X-RNS-RETRY-AFTER"
+)
+
+//HeaderReadOnly is set on a Open request to open a read only Session
+const HeaderReadOnly = "X-RNS-READONLY"